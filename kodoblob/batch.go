@@ -0,0 +1,321 @@
+package kodoblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/qiniu/go-sdk/v7/client"
+	"github.com/qiniu/go-sdk/v7/storage"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+const (
+	// maxBatchSize is the max number of operations of a Kodo batch request.
+	maxBatchSize        = 1000
+	defaultBatchWorkers = 4
+)
+
+// BatchOp is the kind of a batch operation.
+type BatchOp string
+
+const (
+	BatchStat       BatchOp = "stat"
+	BatchDelete     BatchOp = "delete"
+	BatchCopy       BatchOp = "copy"
+	BatchMove       BatchOp = "move"
+	BatchChangeType BatchOp = "chtype"
+)
+
+// BatchOperation is an operation on Key of the bucket run by Batch.
+type BatchOperation struct {
+	Op  BatchOp
+	Key string
+	// DstKey is the destination of BatchCopy and BatchMove, which fail with
+	// gcerrors.AlreadyExists if it exists unless Overwrite is set.
+	DstKey    string
+	Overwrite bool
+	// FileType is the storage class set by BatchChangeType, 0 for standard, 1
+	// for infrequent access, 2 for archive, 3 for deep archive and 4 for
+	// archive IR.
+	FileType int
+}
+
+func (op *BatchOperation) uri(bucketName string) (string, error) {
+	switch op.Op {
+	case BatchStat:
+		return storage.URIStat(bucketName, op.Key), nil
+	case BatchDelete:
+		return storage.URIDelete(bucketName, op.Key), nil
+	case BatchCopy:
+		return storage.URICopy(bucketName, op.Key, bucketName, op.DstKey, op.Overwrite), nil
+	case BatchMove:
+		return storage.URIMove(bucketName, op.Key, bucketName, op.DstKey, op.Overwrite), nil
+	case BatchChangeType:
+		return storage.URIChangeType(bucketName, op.Key, op.FileType), nil
+	default:
+		return "", fmt.Errorf("kodoblob: unsupported batch operation %q", op.Op)
+	}
+}
+
+// BatchResult is the result of a batch operation.
+type BatchResult struct {
+	// Code is gcerrors.OK if the operation succeeds, otherwise the error code
+	// of Err.
+	Code gcerrors.ErrorCode
+	Err  error
+	// Info is the stat result of BatchStat.
+	Info *storage.FileInfo
+}
+
+// Batch runs the operations on the kodoblob bucket by the batch requests of
+// Kodo, each of which contains up to 1000 operations, and at most workers
+// batch requests are sent concurrently, 4 if workers is not positive. The
+// operations of different batch requests run in no particular order.
+//
+// The results are in the order of ops. The failed requests and operations are
+// retried by the retry policy of the bucket, BatchDelete succeeds if the object
+// is not found on retry as it may be deleted by the failed attempt. Likewise,
+// if the retry of BatchCopy or BatchMove finds the destination existing or the
+// source moved, the objects are checked by stat and the operation succeeds if
+// the failed attempt has done it, see CopyBetween. Batch only fails if bucket
+// is not a kodoblob bucket.
+func Batch(ctx context.Context, bucket *blob.Bucket, ops []BatchOperation, workers int) ([]BatchResult, error) {
+	b, err := kodoBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = defaultBatchWorkers
+	}
+	results := make([]BatchResult, len(ops))
+	var (
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, workers)
+	)
+	for start := 0; start < len(ops); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(start, end int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			b.batch(ctx, ops[start:end], results[start:end])
+		}(start, end)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// batch runs up to maxBatchSize operations by a batch request and sets their
+// results, retrying the operations failed with retryable errors.
+func (b *bucket) batch(ctx context.Context, ops []BatchOperation, results []BatchResult) {
+	var (
+		pending = make([]int, 0, len(ops))
+		uris    = make([]string, len(ops))
+		tried   = make([]bool, len(ops))
+		// retried reports whether the result is from a retry, after which the
+		// failed attempts may have been applied.
+		retried = make([]bool, len(ops))
+	)
+	setResult := func(i int, err error) {
+		retried[i] = tried[i]
+		if err != nil && tried[i] && ops[i].Op == BatchDelete && ErrorCode(err) == gcerrors.NotFound {
+			err = nil
+		}
+		results[i] = BatchResult{Code: gcerrors.OK, Err: err}
+		if err != nil {
+			results[i].Code = ErrorCode(err)
+		}
+	}
+	defer func() {
+		for i := range ops {
+			op := &ops[i]
+			if !retried[i] || results[i].Err == nil || op.Op != BatchCopy && op.Op != BatchMove {
+				continue
+			}
+			if done, err := transferred(ctx, b, op.Key, b, op.DstKey, op.Op == BatchMove, results[i].Err); err == nil && done {
+				results[i] = BatchResult{Code: gcerrors.OK}
+			}
+		}
+	}()
+	for i := range ops {
+		uri, err := ops[i].uri(b.name)
+		if err != nil {
+			setResult(i, err)
+			continue
+		}
+		uris[i] = uri
+		pending = append(pending, i)
+	}
+
+	policy := b.retryPolicy
+	for try := 0; try < policy.tryTimes && len(pending) > 0; try++ {
+		if try > 0 {
+			if err := policy.wait(ctx, try); err != nil {
+				for _, i := range pending {
+					setResult(i, err)
+				}
+				return
+			}
+		}
+		operations := make([]string, len(pending))
+		for j, i := range pending {
+			operations[j] = uris[i]
+		}
+		rets, err := b.bucketManager.BatchWithContext(ctx, b.name, operations)
+		if err == nil && len(rets) != len(pending) {
+			err = fmt.Errorf("kodoblob: batch returns %d results for %d operations", len(rets), len(pending))
+		}
+		if err != nil {
+			for _, i := range pending {
+				setResult(i, err)
+				tried[i] = true
+			}
+			if !isRetryableError(err) || ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		var retries []int
+		for j, i := range pending {
+			ret := &rets[j]
+			if ret.Code == 0 || ret.Code/100 == 2 {
+				setResult(i, nil)
+				if ops[i].Op == BatchStat {
+					results[i].Info = &storage.FileInfo{
+						Fsize:    ret.Data.Fsize,
+						Hash:     ret.Data.Hash,
+						MimeType: ret.Data.MimeType,
+						Type:     ret.Data.Type,
+						PutTime:  ret.Data.PutTime,
+						Md5:      ret.Data.Md5,
+						EndUser:  ret.Data.EndUser,
+					}
+				}
+				continue
+			}
+			err := &client.ErrorInfo{Code: ret.Code, Err: ret.Data.Error}
+			setResult(i, err)
+			tried[i] = true
+			if isRetryableError(err) {
+				retries = append(retries, i)
+			}
+		}
+		pending = retries
+	}
+}
+
+// DeletePrefix deletes all objects under prefix of the kodoblob bucket by batch
+// delete while listing them, with at most workers concurrent batch requests,
+// see Batch. It returns the number of deleted objects and the first error of
+// listing or deletion, the objects not found are not counted nor considered as
+// errors.
+func DeletePrefix(ctx context.Context, bucket *blob.Bucket, prefix string, workers int) (int, error) {
+	deleted := 0
+	err := batchPrefix(ctx, bucket, prefix, "", workers, func(key string) BatchOperation {
+		return BatchOperation{Op: BatchDelete, Key: key}
+	}, func(_ int, _ []BatchOperation, results []BatchResult) error {
+		for _, result := range results {
+			switch result.Code {
+			case gcerrors.OK:
+				deleted++
+			case gcerrors.NotFound:
+			default:
+				return result.Err
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// batchPrefix lists the objects under prefix, skipping the keys not after
+// startAfter, and runs the operations created by newOp for them in batches
+// while listing, with at most workers concurrent batch requests. done is called
+// serially with the sequence number, operations and results of each batch, its
+// error stops the listing and is returned.
+func batchPrefix(ctx context.Context, bucket *blob.Bucket, prefix, startAfter string, workers int, newOp func(key string) BatchOperation, done func(seq int, ops []BatchOperation, results []BatchResult) error) error {
+	if _, err := kodoBucket(bucket); err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = defaultBatchWorkers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type prefixBatch struct {
+		seq int
+		ops []BatchOperation
+	}
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+		batches  = make(chan prefixBatch)
+	)
+	setError := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				results, _ := Batch(ctx, bucket, batch.ops, 1)
+				lock.Lock()
+				if firstErr == nil {
+					if err := done(batch.seq, batch.ops, results); err != nil {
+						setError(err)
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	err := func() error {
+		defer close(batches)
+		var (
+			seq  int
+			ops  = make([]BatchOperation, 0, maxBatchSize)
+			iter = bucket.List(&blob.ListOptions{Prefix: prefix})
+		)
+		for {
+			object, err := iter.Next(ctx)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err == nil && object.Key > startAfter {
+				ops = append(ops, newOp(object.Key))
+			}
+			if len(ops) == maxBatchSize || err == io.EOF && len(ops) > 0 {
+				select {
+				case batches <- prefixBatch{seq: seq, ops: ops}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				seq++
+				ops = make([]BatchOperation, 0, maxBatchSize)
+			}
+			if err == io.EOF {
+				return nil
+			}
+		}
+	}()
+	wg.Wait()
+	if err != nil {
+		setError(err)
+	}
+	return firstErr
+}
@@ -0,0 +1,24 @@
+package kodoblob
+
+// CopyOptions controls how the kodoblob bucket copies objects, it is set per
+// copy by CopyOptions.BeforeCopy, whose asFunc converts its argument to
+// **CopyOptions.
+//
+// Kodo copies the object with its MIME type, metadata and storage class, the
+// replacements are applied to the destination by separate requests once it is
+// copied, so the copy is not rolled back if they fail.
+type CopyOptions struct {
+	// NoOverwrite fails the copy with gcerrors.AlreadyExists if the
+	// destination exists.
+	NoOverwrite bool
+	// ContentType replaces the MIME type of the destination if it is not
+	// empty.
+	ContentType string
+	// Metadata adds or replaces the metadata of the destination, the metadata
+	// not in it is kept from the source.
+	Metadata map[string]string
+	// FileType changes the storage class of the destination if it is not nil,
+	// 0 for standard, 1 for infrequent access, 2 for archive, 3 for deep
+	// archive and 4 for archive IR.
+	FileType *int
+}
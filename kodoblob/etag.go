@@ -0,0 +1,104 @@
+package kodoblob
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+)
+
+// etagBlockSize is the block size of the Kodo etag, see
+// https://developer.qiniu.com/kodo/1231/appendix#qiniu-etag
+const etagBlockSize = 4 * 1024 * 1024
+
+// etag computes the Kodo etag of an object part by part. The etag of an object
+// uploaded in a single part, or in parts of etagBlockSize, is the etag v1 of its
+// content, otherwise it is the etag v2 combining the etag v1 of the parts.
+type etag struct {
+	parts    [][]byte
+	lastSize int64
+	aligned  bool
+}
+
+func newEtag() *etag {
+	return &etag{aligned: true}
+}
+
+// addPart adds the next part of the object.
+func (e *etag) addPart(data []byte) {
+	// Reading from bytes.Reader never fails.
+	_ = e.addPartFrom(bytes.NewReader(data), int64(len(data)))
+}
+
+// addParts reads the object of the known size from r and adds it in parts of
+// partSize.
+func (e *etag) addParts(r io.ReaderAt, size, partSize int64) error {
+	for offset := int64(0); ; offset += partSize {
+		n := size - offset
+		if n > partSize {
+			n = partSize
+		}
+		if err := e.addPartFrom(io.NewSectionReader(r, offset, n), n); err != nil {
+			return err
+		}
+		if offset+n >= size {
+			return nil
+		}
+	}
+}
+
+func (e *etag) addPartFrom(r io.Reader, size int64) error {
+	sum, err := etagV1(r, size)
+	if err != nil {
+		return err
+	}
+	if len(e.parts) > 0 && e.lastSize != etagBlockSize {
+		e.aligned = false
+	}
+	e.parts = append(e.parts, sum)
+	e.lastSize = size
+	return nil
+}
+
+func (e *etag) String() string {
+	switch len(e.parts) {
+	case 0:
+		sum, _ := etagV1(bytes.NewReader(nil), 0)
+		return base64.URLEncoding.EncodeToString(sum)
+	case 1:
+		return base64.URLEncoding.EncodeToString(e.parts[0])
+	}
+	h := sha1.New()
+	for _, part := range e.parts {
+		h.Write(part[1:])
+	}
+	prefix := byte(0x9e)
+	if e.aligned {
+		prefix = 0x96
+	}
+	return base64.URLEncoding.EncodeToString(h.Sum([]byte{prefix}))
+}
+
+// etagV1 returns the binary etag v1 of size bytes read from r.
+func etagV1(r io.Reader, size int64) ([]byte, error) {
+	h := sha1.New()
+	if size <= etagBlockSize {
+		if _, err := io.CopyN(h, r, size); err != nil {
+			return nil, err
+		}
+		return h.Sum([]byte{0x16}), nil
+	}
+	blockHash := sha1.New()
+	for ; size > 0; size -= etagBlockSize {
+		n := size
+		if n > etagBlockSize {
+			n = etagBlockSize
+		}
+		blockHash.Reset()
+		if _, err := io.CopyN(blockHash, r, n); err != nil {
+			return nil, err
+		}
+		h.Write(blockHash.Sum(nil))
+	}
+	return h.Sum([]byte{0x96}), nil
+}
@@ -1,19 +1,28 @@
 package kodoblob
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/qiniu/go-sdk/v7/auth"
+	"github.com/qiniu/go-sdk/v7/client"
 	"github.com/qiniu/go-sdk/v7/storage"
 	"gocloud.dev/blob"
 	"gocloud.dev/blob/driver"
@@ -30,8 +39,12 @@ var (
 	ErrNoAccessKey                 = errors.New("no accessKey provided")
 	ErrNoSecretKey                 = errors.New("no secretKey provided")
 	ErrNoDownloadDomain            = errors.New("no downloadDomain provided")
-	ErrNotSupportedSignedPutUrl    = errors.New("kodoblob: does not support SignedURL for PUT")
-	ErrNotSupportedSignedDeleteUrl = errors.New("kodoblob: does not support SignedURL for DELETE")
+	ErrNoS3Region                  = errors.New("kodoblob: could not determine the S3 region of the bucket")
+	ErrContentMD5Mismatch          = errors.New("kodoblob: ContentMD5 does not match the written content")
+	ErrEtagMismatch                = errors.New("kodoblob: etag of the uploaded object does not match the written content")
+	ErrNegativeSize                = errors.New("kodoblob: size must not be negative")
+	ErrNotSupportedSignedPutUrl    = errors.New("kodoblob: does not support SignedURL for PUT")    // Deprecated: no longer returned.
+	ErrNotSupportedSignedDeleteUrl = errors.New("kodoblob: does not support SignedURL for DELETE") // Deprecated: no longer returned.
 
 	appName   = fmt.Sprintf("QiniuGoCloudDevKodoBlob/%s", version)
 	userAgent = fmt.Sprintf("%s (%s; %s; %s) %s", appName, runtime.GOOS, runtime.GOARCH, runtime.Compiler, runtime.Version())
@@ -59,20 +72,67 @@ func (o *urlSessionOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob
 	}
 	_, signDownloadUrl := u.Query()["signDownloadUrl"]
 	_, preferHttps := u.Query()["useHttps"]
-	uploadConfig := storage.UploadConfig{
-		UseHTTPS:      preferHttps,
-		UseCdnDomains: true,
+	s3Endpoint, err := o.createS3Endpoint(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	partSize, err := o.parseIntOption(u.Query(), "partSize", defaultPartSize, 1)
+	if err != nil {
+		return nil, err
+	}
+	maxConcurrency, err := o.parseIntOption(u.Query(), "maxConcurrency", defaultMaxConcurrency, 1)
+	if err != nil {
+		return nil, err
+	}
+	formUploadThreshold, err := o.parseIntOption(u.Query(), "formUploadThreshold", defaultFormUploadThreshold, 0)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := o.createRecorder(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	writeOptions, err := o.createWriteOptions(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	upHostType, accUpHosts, err := o.createUpHostType(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	config.UseCdnDomains = upHostType != upHostTypeSrc
+	retryPolicy, err := o.createRetryPolicy(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	hostFreezeDuration, err := o.parseDurationOption(u.Query(), "hostFreezeDuration", defaultHostFreezeDuration)
+	if err != nil {
+		return nil, err
 	}
-	return blob.NewBucket(&bucket{
+	b := &bucket{
 		name:                u.Host,
 		downloadDomains:     downloadDomains,
 		credentials:         credentials,
 		config:              config,
 		willSignDownloadUrl: signDownloadUrl,
 		preferHttps:         preferHttps,
+		s3EndpointUrl:       s3Endpoint,
+		s3Region:            u.Query().Get("s3Region"),
 		bucketManager:       storage.NewBucketManager(credentials, config),
-		uploadManager:       storage.NewUploadManager(&uploadConfig),
-	}), nil
+		partSize:            partSize,
+		maxConcurrency:      maxConcurrency,
+		formUploadThreshold: formUploadThreshold,
+		recorder:            recorder,
+		writeOptions:        writeOptions,
+		upHostType:          upHostType,
+		accUpHosts:          accUpHosts,
+		retryPolicy:         retryPolicy,
+		hostFreezer:         newHostFreezer(hostFreezeDuration),
+	}
+	if _, listPrefetch := u.Query()["listPrefetch"]; listPrefetch {
+		b.listPrefetcher = newListPrefetcher(b.listFiles)
+	}
+	return blob.NewBucket(b), nil
 }
 
 func (o *urlSessionOpener) createCredentials(userInfo *url.Userinfo) (*auth.Credentials, error) {
@@ -95,7 +155,7 @@ func (o *urlSessionOpener) createCredentials(userInfo *url.Userinfo) (*auth.Cred
 func (o *urlSessionOpener) createConfig(query url.Values) (*storage.Config, error) {
 	var (
 		config    = &storage.Config{UseCdnDomains: true}
-		region    *storage.Region
+		region    = new(storage.Region)
 		useRegion = false
 	)
 	if ucHosts, ok := query["bucketHost"]; ok {
@@ -154,6 +214,89 @@ func (o *urlSessionOpener) createDownloadDomains(query url.Values) ([]*url.URL,
 	return downloadUrls, nil
 }
 
+func (o *urlSessionOpener) createS3Endpoint(query url.Values) (*url.URL, error) {
+	if s3Endpoint := query.Get("s3Endpoint"); s3Endpoint != "" {
+		_, useHttps := query["useHttps"]
+		return parseEndpoint(s3Endpoint, useHttps)
+	}
+	return nil, nil
+}
+
+func (o *urlSessionOpener) createRecorder(query url.Values) (storage.Recorder, error) {
+	if recorderDir := query.Get("recorderDir"); recorderDir != "" {
+		return storage.NewFileRecorder(recorderDir)
+	}
+	return nil, nil
+}
+
+func (o *urlSessionOpener) createUpHostType(query url.Values) (string, []string, error) {
+	upHostType := query.Get("upHostType")
+	switch upHostType {
+	case "":
+		upHostType = upHostTypeCdn
+	case upHostTypeCdn, upHostTypeSrc:
+	case upHostTypeAcc:
+		if len(query["accUpHost"]) == 0 {
+			return "", nil, errors.New("kodoblob: accUpHost is required by upHostType acc")
+		}
+	default:
+		return "", nil, fmt.Errorf("kodoblob: invalid upHostType %q", upHostType)
+	}
+	return upHostType, query["accUpHost"], nil
+}
+
+func (o *urlSessionOpener) createRetryPolicy(query url.Values) (retryPolicy retryPolicy, err error) {
+	if retryPolicy.tryTimes, err = o.parseIntOption(query, "uploadTryTimes", defaultUploadTryTimes, 1); err != nil {
+		return
+	}
+	if retryPolicy.interval, err = o.parseDurationOption(query, "uploadRetryInterval", defaultUploadRetryInterval); err != nil {
+		return
+	}
+	retryPolicy.maxInterval, err = o.parseDurationOption(query, "uploadRetryMaxInterval", defaultUploadRetryMaxInterval)
+	return
+}
+
+func (o *urlSessionOpener) parseDurationOption(query url.Values, name string, defaultValue time.Duration) (time.Duration, error) {
+	value := query.Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("kodoblob: invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+func (o *urlSessionOpener) parseIntOption(query url.Values, name string, defaultValue, minValue int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < minValue {
+		return 0, fmt.Errorf("kodoblob: invalid %s %q", name, value)
+	}
+	return i, nil
+}
+
+// parseBoolOption parses the option of name, which is true if it is present
+// without a value.
+func (o *urlSessionOpener) parseBoolOption(query url.Values, name string) (bool, error) {
+	if _, ok := query[name]; !ok {
+		return false, nil
+	}
+	value := query.Get(name)
+	if value == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("kodoblob: invalid %s %q", name, value)
+	}
+	return b, nil
+}
+
 type bucket struct {
 	name                string
 	downloadDomains     []*url.URL
@@ -161,16 +304,78 @@ type bucket struct {
 	preferHttps         bool
 	credentials         *auth.Credentials
 	config              *storage.Config
-	uploadManager       *storage.UploadManager
+	partSize            int
+	maxConcurrency      int
+	formUploadThreshold int
+	recorder            storage.Recorder
+	writeOptions        *WriteOptions
+	upHostType          string
+	accUpHosts          []string
+	retryPolicy         retryPolicy
+	hostFreezer         *hostFreezer
+	listPrefetcher      *listPrefetcher
 	bucketManager       *storage.BucketManager
+
+	s3Lock        sync.Mutex
+	s3EndpointUrl *url.URL
+	s3Region      string
 }
 
 func (b *bucket) Close() error {
+	if b.listPrefetcher != nil {
+		b.listPrefetcher.close()
+	}
 	return nil
 }
 
 func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
-	// TODO
+	var (
+		errorInfo  *client.ErrorInfo
+		statusCode ErrStatusCode
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return gcerrors.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return gcerrors.DeadlineExceeded
+	case errors.Is(err, ErrContentMD5Mismatch):
+		return gcerrors.FailedPrecondition
+	case errors.Is(err, ErrNegativeSize):
+		return gcerrors.InvalidArgument
+	case errors.Is(err, ErrEtagMismatch):
+		// gcerrors has no DataLoss code, errors.Is tells the mismatch apart.
+		return gcerrors.Internal
+	case errors.As(err, &errorInfo):
+		return errorCodeOfStatus(errorInfo.Code)
+	case errors.As(err, &statusCode):
+		return errorCodeOfStatus(statusCode.code)
+	default:
+		return gcerrors.Unknown
+	}
+}
+
+// errorCodeOfStatus maps the HTTP status codes and Kodo specific status codes
+// to error codes, see https://developer.qiniu.com/kodo/3928/error-responses
+func errorCodeOfStatus(code int) gcerrors.ErrorCode {
+	switch code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return gcerrors.InvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return gcerrors.PermissionDenied
+	case http.StatusNotFound, 612, 631:
+		return gcerrors.NotFound
+	case 614:
+		return gcerrors.AlreadyExists
+	case 608, 701:
+		return gcerrors.FailedPrecondition
+	case http.StatusTooManyRequests, 573:
+		return gcerrors.ResourceExhausted
+	case http.StatusNotImplemented:
+		return gcerrors.Unimplemented
+	}
+	if code >= 500 && code < 600 {
+		return gcerrors.Internal
+	}
 	return gcerrors.Unknown
 }
 
@@ -178,62 +383,124 @@ const defaultPageSize = 1000
 
 func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
 	var (
-		pageSize         int
-		listInputOptions = make([]storage.ListInputOption, 0, 4)
-		listResult       driver.ListPage
+		page       listPage
+		listResult driver.ListPage
+		filter     *ListFilter
 	)
 
 	if opts != nil {
-		if opts.Prefix != "" {
-			listInputOptions = append(listInputOptions, storage.ListInputOptionsPrefix(opts.Prefix))
-		}
-		if opts.Delimiter != "" {
-			listInputOptions = append(listInputOptions, storage.ListInputOptionsDelimiter(opts.Delimiter))
+		page.prefix = opts.Prefix
+		page.delimiter = opts.Delimiter
+		page.marker = string(opts.PageToken)
+		page.pageSize = opts.PageSize
+		if opts.BeforeList != nil {
+			asFunc := func(i interface{}) bool {
+				p, ok := i.(**ListFilter)
+				if !ok {
+					return false
+				}
+				if filter == nil {
+					filter = new(ListFilter)
+				}
+				*p = filter
+				return true
+			}
+			if err := opts.BeforeList(asFunc); err != nil {
+				return nil, err
+			}
 		}
-		if len(opts.PageToken) > 0 {
-			listInputOptions = append(listInputOptions, storage.ListInputOptionsMarker(string(opts.PageToken)))
+		if filter != nil {
+			if err := filter.validate(); err != nil {
+				return nil, err
+			}
 		}
-		pageSize = opts.PageSize
 	}
 
-	if pageSize == 0 {
-		pageSize = defaultPageSize
+	if page.pageSize == 0 {
+		page.pageSize = defaultPageSize
 	}
-	listInputOptions = append(listInputOptions, storage.ListInputOptionsLimit(pageSize))
 
-	if listFilesRet, hasNext, err := b.bucketManager.ListFilesWithContext(ctx, b.name, listInputOptions...); err != nil {
-		return nil, err
+	var result listPageResult
+	if b.listPrefetcher != nil {
+		result = b.listPrefetcher.get(ctx, page)
 	} else {
-		if hasNext {
-			listResult.NextPageToken = []byte(listFilesRet.Marker)
-		}
-		listResult.Objects = make([]*driver.ListObject, 0, len(listFilesRet.CommonPrefixes)+len(listFilesRet.Items))
-		for _, commonPrefix := range listFilesRet.CommonPrefixes {
-			listResult.Objects = append(listResult.Objects, &driver.ListObject{
-				Key:   commonPrefix,
-				IsDir: true,
-			})
-		}
-		for _, item := range listFilesRet.Items {
-			listResult.Objects = append(listResult.Objects, &driver.ListObject{
-				Key:     item.Key,
-				ModTime: time.UnixMicro(item.PutTime * 10),
-				Size:    item.Fsize,
-				MD5:     []byte(item.Md5),
-				IsDir:   false,
-			})
-		}
-		if len(listResult.Objects) > 0 {
-			sort.Slice(listResult.Objects, func(i, j int) bool {
-				return listResult.Objects[i].Key < listResult.Objects[j].Key
-			})
+		result = b.listFiles(ctx, page)
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+	listFilesRet := result.ret
+	if result.hasNext {
+		listResult.NextPageToken = []byte(listFilesRet.Marker)
+	}
+	listResult.Objects = make([]*driver.ListObject, 0, len(listFilesRet.CommonPrefixes)+len(listFilesRet.Items))
+	for _, commonPrefix := range listFilesRet.CommonPrefixes {
+		listResult.Objects = append(listResult.Objects, &driver.ListObject{
+			Key:   commonPrefix,
+			IsDir: true,
+		})
+	}
+	for i := range listFilesRet.Items {
+		if filter != nil && !filter.match(&listFilesRet.Items[i]) {
+			continue
 		}
+		listResult.Objects = append(listResult.Objects, listObject(listFilesRet.Items[i]))
+	}
+	if len(listResult.Objects) > 0 {
+		sort.Slice(listResult.Objects, func(i, j int) bool {
+			return listResult.Objects[i].Key < listResult.Objects[j].Key
+		})
 	}
 
 	return &listResult, nil
 }
 
+func (b *bucket) listFiles(ctx context.Context, page listPage) listPageResult {
+	listInputOptions := make([]storage.ListInputOption, 0, 4)
+	if page.prefix != "" {
+		listInputOptions = append(listInputOptions, storage.ListInputOptionsPrefix(page.prefix))
+	}
+	if page.delimiter != "" {
+		listInputOptions = append(listInputOptions, storage.ListInputOptionsDelimiter(page.delimiter))
+	}
+	if page.marker != "" {
+		listInputOptions = append(listInputOptions, storage.ListInputOptionsMarker(page.marker))
+	}
+	listInputOptions = append(listInputOptions, storage.ListInputOptionsLimit(page.pageSize))
+
+	listFilesRet, hasNext, err := b.bucketManager.ListFilesWithContext(ctx, b.name, listInputOptions...)
+	return listPageResult{ret: listFilesRet, hasNext: hasNext, err: err}
+}
+
+// listObject converts the listed item, which is also available by As with
+// *storage.ListItem for its hash, MIME type, storage type, status and end user.
+func listObject(item storage.ListItem) *driver.ListObject {
+	md5Value, err := hex.DecodeString(item.Md5)
+	if err != nil {
+		md5Value = nil
+	}
+	return &driver.ListObject{
+		Key:     item.Key,
+		ModTime: time.Unix(0, item.PutTime*100),
+		Size:    item.Fsize,
+		MD5:     md5Value,
+		IsDir:   false,
+		AsFunc: func(i interface{}) bool {
+			p, ok := i.(*storage.ListItem)
+			if !ok {
+				return false
+			}
+			*p = item
+			return true
+		},
+	}
+}
+
 func (b *bucket) As(i interface{}) bool {
+	if p, ok := i.(**bucket); ok {
+		*p = b
+		return true
+	}
 	return false
 }
 
@@ -279,10 +546,10 @@ func (b *bucket) Attributes(ctx context.Context, key string) (*driver.Attributes
 func (b *bucket) attributes(response *http.Response) (*driver.Attributes, error) {
 	headers := response.Header
 	attributes := driver.Attributes{
-		CacheControl:       headers.Get("Cache-Control"),
-		ContentDisposition: headers.Get("Content-Disposition"),
-		ContentEncoding:    headers.Get("Content-Encoding"),
-		ContentLanguage:    headers.Get("Content-Language"),
+		CacheControl:       persistedHeader(headers, "Cache-Control"),
+		ContentDisposition: persistedHeader(headers, "Content-Disposition"),
+		ContentEncoding:    persistedHeader(headers, "Content-Encoding"),
+		ContentLanguage:    persistedHeader(headers, "Content-Language"),
 		ContentType:        headers.Get("Content-Type"),
 		ETag:               headers.Get("Etag"),
 		MD5:                []byte(headers.Get("Content-Md5")),
@@ -298,12 +565,38 @@ func (b *bucket) attributes(response *http.Response) (*driver.Attributes, error)
 		k = strings.ToLower(k)
 		if len(v) > 0 && strings.HasPrefix(k, "x-qn-meta-") {
 			k = strings.TrimPrefix(k, "x-qn-meta-")
-			attributes.Metadata[k] = v[0]
+			if !isPersistedHeader(k) {
+				attributes.Metadata[k] = v[0]
+			}
 		}
 	}
 	return &attributes, nil
 }
 
+// Kodo only persists the x-qn-meta-* headers of an object, so the standard
+// headers below are saved as metadata on write and restored by attributes.
+// Only Attributes of this driver restores them, the downloads of the object,
+// e.g. by browsers, CDN or NewRangeReader, do not respond with these headers.
+// The user metadata of the same names, e.g. "cache-control", are taken as
+// these headers and never returned in Metadata.
+var persistedHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language"}
+
+func persistedHeader(headers http.Header, name string) string {
+	if value := headers.Get(name); value != "" {
+		return value
+	}
+	return headers.Get("X-Qn-Meta-" + name)
+}
+
+func isPersistedHeader(metadataKey string) bool {
+	for _, name := range persistedHeaders {
+		if strings.EqualFold(name, metadataKey) {
+			return true
+		}
+	}
+	return false
+}
+
 type reader struct {
 	attributes *driver.Attributes
 	body       io.ReadCloser
@@ -364,77 +657,221 @@ func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length
 }
 
 type writer struct {
-	b           *bucket
-	key         string
-	ctx         context.Context
-	putPolicy   storage.PutPolicy
-	uploadExtra storage.UploadExtra
-	source      storage.UploadSource
-	wg          sync.WaitGroup
-	err         error
-	pw          io.WriteCloser
+	upload     *multipartUpload
+	contentMD5 []byte
+	hash       hash.Hash
+	buf        []byte
+	partNumber int64
+	closed     bool
+
+	// formUploadThreshold is the max size of objects uploaded in a single
+	// form upload request instead of multipart upload.
+	formUploadThreshold int
+	// onComplete receives the response of the upload.
+	onComplete func(UploadResult)
+	// etag is nil if the response is customized and may not contain the hash.
+	etag *etag
+	// source is the reader of the known size passed to Upload, which is
+	// uploaded by Close, sourcePath is the path of the local file if it is.
+	source     io.ReaderAt
+	sourceSize int64
+	sourcePath string
 }
 
-func (w *writer) Close() error {
-	if w.pw != nil {
-		err := w.pw.Close()
-		if err == nil {
-			err = w.err
-		}
-		w.err = nil
-		w.source = nil
-		w.pw = nil
-		w.wg.Wait()
-		return err
-	} else {
-		return nil
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.upload.error(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.spare(), p)
+		w.buf = w.buf[:len(w.buf)+n]
+		if w.hash != nil {
+			w.hash.Write(p[:n])
+		}
+		written += n
+		p = p[n:]
+		if len(w.buf) == w.upload.partSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
 	}
+	return written, nil
 }
 
-func (w *writer) Write(p []byte) (int, error) {
-	if w.pw == nil {
-		var err error
-		pr, pw := io.Pipe()
-		w.pw = pw
-		if w.source, err = storage.NewUploadSourceReader(pr, -1); err != nil {
-			return 0, err
-		}
-		w.wg.Add(1)
-		go func() {
-			defer w.wg.Done()
-
-			var ret storage.UploadRet
-			w.err = w.b.uploadManager.Put(w.ctx, &ret, w.putPolicy.UploadToken(w.b.credentials), &w.key, w.source, &w.uploadExtra)
-			if w.pw != nil {
-				w.source = nil
-				w.pw.Close()
-				w.pw = nil
-			} else {
-				w.err = nil
+// Upload reads r into the part buffers directly instead of copying through Write.
+// Local files and section readers are uploaded with their known sizes by Close,
+// so that the object is not committed before Close, which may abort the write.
+func (w *writer) Upload(r io.Reader) error {
+	switch source := r.(type) {
+	case *os.File:
+		if info, err := source.Stat(); err == nil && info.Mode().IsRegular() {
+			if offset, err := source.Seek(0, io.SeekCurrent); err == nil && offset == 0 {
+				w.source, w.sourceSize, w.sourcePath = source, info.Size(), source.Name()
+				return nil
 			}
-		}()
+		}
+	case *io.SectionReader:
+		if offset, err := source.Seek(0, io.SeekCurrent); err == nil && offset == 0 {
+			w.source, w.sourceSize = source, source.Size()
+			return nil
+		}
 	}
-	if w.err != nil {
-		return 0, w.err
+	for {
+		spare := w.spare()
+		n, err := io.ReadFull(r, spare)
+		if w.hash != nil {
+			w.hash.Write(spare[:n])
+		}
+		w.buf = w.buf[:len(w.buf)+n]
+		switch err {
+		case nil:
+			if len(w.buf) < w.upload.partSize {
+				continue
+			}
+			if err = w.flush(); err != nil {
+				return err
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			// Fail the upload, so that Close does not complete it with partial content.
+			w.upload.setError(err)
+			return err
+		}
 	}
-	return w.pw.Write(p)
 }
 
-func (w *writer) Upload(r io.Reader) error {
-	if w.pw != nil {
-		_, err := io.Copy(w.pw, r)
-		if err != nil {
+// uploadReaderAt uploads r of the known size, small objects are uploaded in a
+// single form upload and the others are uploaded in parts concurrently. If path
+// is set and the bucket has a recorder, the local file at path is uploaded
+// resumably by the SDK.
+func (w *writer) uploadReaderAt(r io.ReaderAt, size int64, path string) error {
+	if err := w.upload.ctx.Err(); err != nil {
+		return err
+	}
+	if w.hash != nil {
+		if _, err := io.Copy(w.hash, io.NewSectionReader(r, 0, size)); err != nil {
+			return err
+		}
+		if err := w.verifyContentMD5(); err != nil {
+			return err
+		}
+	}
+	if w.etag != nil {
+		if err := w.etag.addParts(r, size, int64(w.upload.partSize)); err != nil {
 			return err
 		}
-		return w.Close()
+	}
+	var (
+		ret json.RawMessage
+		err error
+	)
+	if size <= int64(w.formUploadThreshold) && size <= int64(w.upload.partSize) {
+		err = w.upload.formUpload(io.NewSectionReader(r, 0, size), size, &ret)
+	} else if path != "" && w.upload.b.recorder != nil {
+		if path, err = filepath.Abs(path); err == nil {
+			err = w.upload.uploadFile(path, size, &ret)
+		}
 	} else {
-		r, err := storage.NewUploadSourceReader(r, -1)
-		if err != nil {
+		err = w.upload.uploadReaderAt(r, size, &ret)
+	}
+	if err != nil {
+		return err
+	}
+	return w.finish(ret)
+}
+
+// finish verifies the hash in the response of the upload against the etag of
+// the written content and reports the response to onComplete.
+func (w *writer) finish(body json.RawMessage) error {
+	var result UploadResult
+	// The response may be customized into any JSON value, leave Key and Hash
+	// empty if it is not an object.
+	_ = json.Unmarshal(body, &result)
+	result.Body = body
+	if w.etag != nil && result.Hash != "" {
+		if expected := w.etag.String(); result.Hash != expected {
+			return fmt.Errorf("%w: expected %s, got %s", ErrEtagMismatch, expected, result.Hash)
+		}
+	}
+	if w.onComplete != nil {
+		w.onComplete(result)
+	}
+	return nil
+}
+
+func (w *writer) verifyContentMD5() error {
+	if w.hash != nil {
+		if actual := w.hash.Sum(nil); !bytes.Equal(actual, w.contentMD5) {
+			return fmt.Errorf("%w: expected %X, got %X", ErrContentMD5Mismatch, w.contentMD5, actual)
+		}
+	}
+	return nil
+}
+
+// spare returns the free space of the part buffer. The buffer of the first
+// part grows on demand, so that small objects do not take a whole part.
+func (w *writer) spare() []byte {
+	partSize := w.upload.partSize
+	if w.buf == nil && w.partNumber > 0 {
+		w.buf = w.upload.buffer()
+	} else if len(w.buf) == cap(w.buf) && cap(w.buf) < partSize {
+		size := 2 * cap(w.buf)
+		if size < initialBufferSize {
+			size = initialBufferSize
+		} else if size > partSize {
+			size = partSize
+		}
+		buf := make([]byte, len(w.buf), size)
+		copy(buf, w.buf)
+		w.buf = buf
+	}
+	return w.buf[len(w.buf):cap(w.buf)]
+}
+
+func (w *writer) flush() error {
+	w.partNumber += 1
+	buf := w.buf
+	if w.etag != nil {
+		w.etag.addPart(buf)
+	}
+	w.buf = nil
+	return w.upload.uploadPart(w.partNumber, buf)
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.source != nil {
+		return w.uploadReaderAt(w.source, w.sourceSize, w.sourcePath)
+	}
+	if err := w.verifyContentMD5(); err != nil {
+		return w.upload.abort(err)
+	}
+	var ret json.RawMessage
+	w.upload.setTotalBytes(w.partNumber*int64(w.upload.partSize) + int64(len(w.buf)))
+	if w.partNumber == 0 && len(w.buf) <= w.formUploadThreshold {
+		if w.etag != nil {
+			w.etag.addPart(w.buf)
+		}
+		if err := w.upload.formUpload(bytes.NewReader(w.buf), int64(len(w.buf)), &ret); err != nil {
 			return err
 		}
-		var ret storage.UploadRet
-		return w.b.uploadManager.Put(w.ctx, &ret, w.putPolicy.UploadToken(w.b.credentials), &w.key, r, &w.uploadExtra)
+		return w.finish(ret)
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return w.upload.abort(err)
+		}
 	}
+	if err := w.upload.complete(&ret); err != nil {
+		return w.upload.abort(err)
+	}
+	return w.finish(ret)
 }
 
 func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
@@ -442,48 +879,102 @@ func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType str
 		Scope:   fmt.Sprintf("%s:%s", b.name, key),
 		Expires: 24 * 3600,
 	}
-	uploadExtra := storage.UploadExtra{
-		Params:   convertMetadataToParams(opts.Metadata),
+	writeOptions := *b.writeOptions
+	if opts.BeforeWrite != nil {
+		asFunc := func(i interface{}) bool {
+			switch p := i.(type) {
+			case **WriteOptions:
+				*p = &writeOptions
+			case **storage.PutPolicy:
+				*p = &putPolicy
+			default:
+				return false
+			}
+			return true
+		}
+		if err := opts.BeforeWrite(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	writeOptions.applyTo(&putPolicy)
+	if putPolicy.SaveKey != "" && (key == "" || putPolicy.ForceSaveKey) {
+		// The key is decided by Kodo, so the upload token must not be limited
+		// to the requested key. Kodo only allows such a token to create new
+		// objects, a named key keeps its scope to be overwritable.
+		putPolicy.Scope = b.name
+	}
+	params := convertMetadataToParams(opts.Metadata)
+	for name, value := range map[string]string{
+		"Cache-Control":       opts.CacheControl,
+		"Content-Disposition": opts.ContentDisposition,
+		"Content-Encoding":    opts.ContentEncoding,
+		"Content-Language":    opts.ContentLanguage,
+	} {
+		if value != "" {
+			params["x-qn-meta-"+strings.ToLower(name)] = value
+		}
+	}
+	uploadExtra := storage.RputV2Extra{
+		Metadata: params,
 		MimeType: contentType,
 	}
-	return &writer{
-		b:           b,
-		key:         key,
-		ctx:         ctx,
-		putPolicy:   putPolicy,
-		uploadExtra: uploadExtra,
-		source:      nil,
-		err:         nil,
-		pw:          nil,
-	}, nil
+	partSize := opts.BufferSize
+	if partSize <= 0 {
+		partSize = b.partSize
+	}
+	if partSize < minPartSize {
+		partSize = minPartSize
+	} else if partSize > maxPartSize {
+		partSize = maxPartSize
+	}
+	concurrency := opts.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = b.maxConcurrency
+	}
+	w := &writer{
+		upload:              newMultipartUpload(ctx, b, key, putPolicy.UploadToken(b.credentials), uploadExtra, partSize, concurrency),
+		formUploadThreshold: b.formUploadThreshold,
+		contentMD5:          opts.ContentMD5,
+	}
+	if len(w.contentMD5) == 0 {
+		w.contentMD5 = writeOptions.contentMD5
+	}
+	w.upload.onProgress = writeOptions.OnProgress
+	w.onComplete = writeOptions.OnComplete
+	if putPolicy.ReturnBody == "" && putPolicy.CallbackURL == "" {
+		w.etag = newEtag()
+	}
+	if len(w.contentMD5) > 0 {
+		w.hash = md5.New()
+	}
+	return w, nil
 }
 
 func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
-	// TODO: direct ctx supported
-	c := make(chan error)
-	go func() {
-		c <- b.bucketManager.Copy(b.name, srcKey, b.name, dstKey, true)
-	}()
-	select {
-	case err := <-c:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+	var copyOptions CopyOptions
+	if opts != nil && opts.BeforeCopy != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**CopyOptions)
+			if !ok {
+				return false
+			}
+			*p = &copyOptions
+			return true
+		}
+		if err := opts.BeforeCopy(asFunc); err != nil {
+			return err
+		}
 	}
+	return transfer(ctx, b, srcKey, b, dstKey, false, &copyOptions)
 }
 
 func (b *bucket) Delete(ctx context.Context, key string) error {
-	// TODO: direct ctx supported
-	c := make(chan error)
-	go func() {
-		c <- b.bucketManager.Delete(b.name, key)
-	}()
-	select {
-	case err := <-c:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+	retried, err := b.manage(ctx, storage.URIDelete(b.name, key), nil)
+	if retried && b.ErrorCode(err) == gcerrors.NotFound {
+		// The failed attempt before the retry has deleted the object.
+		return nil
 	}
+	return err
 }
 
 func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
@@ -491,9 +982,13 @@ func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedU
 	case http.MethodGet:
 		return b.signDownloadUrl(key, opts.Expiry)
 	case http.MethodPut:
-		return "", ErrNotSupportedSignedPutUrl
+		signOptions := s3SignOptions{expiry: opts.Expiry}
+		if opts.ContentType != "" || opts.EnforceAbsentContentType {
+			signOptions.headers = http.Header{"Content-Type": {opts.ContentType}}
+		}
+		return b.signS3Url(ctx, http.MethodPut, key, &signOptions)
 	case http.MethodDelete:
-		return "", ErrNotSupportedSignedDeleteUrl
+		return b.signS3Url(ctx, http.MethodDelete, key, &s3SignOptions{expiry: opts.Expiry})
 	default:
 		return "", fmt.Errorf("unsupported Method %q", opts.Method)
 	}
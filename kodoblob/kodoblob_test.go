@@ -3,25 +3,34 @@ package kodoblob_test
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
-	_ "github.com/qiniu/go-cdk-driver/kodoblob"
+	"github.com/qiniu/go-cdk-driver/kodoblob"
+	"github.com/qiniu/go-sdk/v7/storage"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 var _ = Describe("KodoBlob", func() {
@@ -40,13 +49,27 @@ var _ = Describe("KodoBlob", func() {
 		upServer    *mockServer
 		apiServer   *mockServer
 	)
-	newBucket := func() *blob.Bucket {
+	newBucket := func(options ...string) *blob.Bucket {
 		values := make(url.Values)
 		values.Set("bucketHost", ucServer.URL())
+		for i := 0; i+1 < len(options); i += 2 {
+			values.Set(options[i], options[i+1])
+		}
 		bucket, err := blob.OpenBucket(context.Background(), "kodo://"+accessKey+":"+secretKey+"@"+bucketName+"?"+values.Encode())
 		Expect(err).NotTo(HaveOccurred())
 		return bucket
 	}
+	decodePutPolicy := func(token string) map[string]any {
+		parts := strings.Split(token, ":")
+		Expect(parts).To(HaveLen(3))
+		Expect(parts[0]).To(Equal(accessKey))
+		policyJson, err := base64.URLEncoding.DecodeString(parts[2])
+		Expect(err).NotTo(HaveOccurred())
+		var putPolicy map[string]any
+		err = json.Unmarshal(policyJson, &putPolicy)
+		Expect(err).NotTo(HaveOccurred())
+		return putPolicy
+	}
 	BeforeEach(func() {
 		os.RemoveAll(filepath.Join(os.TempDir(), "qiniu-golang-sdk"))
 		ioServer = newMockServer()
@@ -74,6 +97,13 @@ var _ = Describe("KodoBlob", func() {
 				})
 				Expect(err).NotTo(HaveOccurred())
 			})
+			mux.HandleFunc("/v2/bucketInfo", func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.Method).To(Equal(http.MethodPost))
+				Expect(r.URL.Query().Get("bucket")).To(Equal(bucketName))
+
+				err := json.NewEncoder(w).Encode(map[string]any{"region": "z0"})
+				Expect(err).NotTo(HaveOccurred())
+			})
 			mux.HandleFunc("/v4/query", func(w http.ResponseWriter, r *http.Request) {
 				Expect(r.Method).To(Equal(http.MethodGet))
 				Expect(r.URL.Path).To(Equal("/v4/query"))
@@ -131,10 +161,12 @@ var _ = Describe("KodoBlob", func() {
 					items = append(items, map[string]any{
 						"key":      fmt.Sprintf("data_%05d", n*1000+i),
 						"hash":     fmt.Sprintf("hash_%05d", n*1000+i),
-						"md5":      fmt.Sprintf("md5_%05d", n*1000+i),
+						"md5":      fmt.Sprintf("%032x", n*1000+i),
 						"fsize":    n*1000 + i,
 						"mimeType": "text/plain",
 						"putTime":  time.Now().UnixNano() / 100,
+						"type":     1,
+						"endUser":  "enduser",
 					})
 				}
 				responseBodyJson := map[string]any{"items": items}
@@ -156,13 +188,335 @@ var _ = Describe("KodoBlob", func() {
 				}
 				Expect(object.Key).To(Equal(fmt.Sprintf("data_%05d", objectCount)))
 				Expect(object.Size).To(Equal(int64(objectCount)))
-				Expect(object.MD5).To(Equal([]byte(fmt.Sprintf("md5_%05d", objectCount))))
+				Expect(hex.EncodeToString(object.MD5)).To(Equal(fmt.Sprintf("%032x", objectCount)))
+				Expect(object.ModTime).To(BeTemporally("~", time.Now(), time.Minute))
 				Expect(object.IsDir).To(BeFalse())
+				var item storage.ListItem
+				Expect(object.As(&item)).To(BeTrue())
+				Expect(item.Hash).To(Equal(fmt.Sprintf("hash_%05d", objectCount)))
+				Expect(item.MimeType).To(Equal("text/plain"))
+				Expect(item.Type).To(Equal(1))
+				Expect(item.EndUser).To(Equal("enduser"))
 				objectCount += 1
 			}
 			Expect(objectCount).To(Equal(6000))
 		})
 
+		It("should prefetch the next page", func(ctx context.Context) {
+			var requests int32
+			rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				atomic.AddInt32(&requests, 1)
+				Expect(r.URL.Query().Get("limit")).To(Equal("10"))
+				if n > 0 {
+					Expect(r.URL.Query().Get("marker")).To(Equal(fmt.Sprintf("marker_%d", n-1)))
+				}
+				items := make([]map[string]any, 0, 10)
+				for i := uint32(0); i < 10; i++ {
+					items = append(items, map[string]any{"key": fmt.Sprintf("data_%05d", n*10+i), "fsize": n*10 + i})
+				}
+				responseBodyJson := map[string]any{"items": items}
+				if n < 2 {
+					responseBodyJson["marker"] = fmt.Sprintf("marker_%d", n)
+				}
+				err := json.NewEncoder(w).Encode(responseBodyJson)
+				Expect(err).NotTo(HaveOccurred())
+			}, 3)
+
+			bucket := newBucket("listPrefetch", "", "rsfHost", rsfServer.URL())
+			defer bucket.Close()
+			page, nextPageToken, err := bucket.ListPage(ctx, blob.FirstPageToken, 10, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page).To(HaveLen(10))
+			Expect(nextPageToken).To(Equal([]byte("marker_0")))
+			Eventually(func() int32 { return atomic.LoadInt32(&requests) }).Should(Equal(int32(2)))
+
+			objectCount := 10
+			for len(nextPageToken) > 0 {
+				page, nextPageToken, err = bucket.ListPage(ctx, nextPageToken, 10, nil)
+				Expect(err).NotTo(HaveOccurred())
+				for _, object := range page {
+					Expect(object.Key).To(Equal(fmt.Sprintf("data_%05d", objectCount)))
+					objectCount += 1
+				}
+			}
+			Expect(objectCount).To(Equal(30))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+		})
+
+		It("should filter the listed files", func(ctx context.Context) {
+			now := time.Now()
+			rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				items := make([]map[string]any, 0, 100)
+				for i := 0; i < 100; i++ {
+					mimeType := "text/plain"
+					if i%2 == 0 {
+						mimeType = "image/png"
+					}
+					items = append(items, map[string]any{
+						"key":      fmt.Sprintf("data_%05d", i),
+						"fsize":    i,
+						"mimeType": mimeType,
+						"putTime":  now.Add(-time.Duration(i)*24*time.Hour).UnixNano() / 100,
+						"type":     i % 4,
+					})
+				}
+				err := json.NewEncoder(w).Encode(map[string]any{"items": items})
+				Expect(err).NotTo(HaveOccurred())
+			}, 2)
+
+			list := func(filter kodoblob.ListFilter) []string {
+				iter := bucket.List(&blob.ListOptions{BeforeList: func(as func(any) bool) error {
+					var listFilter *kodoblob.ListFilter
+					Expect(as(&listFilter)).To(BeTrue())
+					*listFilter = filter
+					return nil
+				}})
+				var keys []string
+				for {
+					object, err := iter.Next(ctx)
+					if err == io.EOF {
+						return keys
+					}
+					Expect(err).NotTo(HaveOccurred())
+					keys = append(keys, object.Key)
+				}
+			}
+			Expect(list(kodoblob.ListFilter{
+				PutTimeBefore: now.Add(-30*24*time.Hour + time.Hour),
+				MinSize:       40,
+				MaxSize:       60,
+				MimeType:      "image/*",
+				FileTypes:     []int{2},
+			})).To(Equal([]string{"data_00042", "data_00046", "data_00050", "data_00054", "data_00058"}))
+			Expect(list(kodoblob.ListFilter{
+				PutTimeAfter: now.Add(-5*24*time.Hour - time.Hour),
+				MimeType:     "!image/png;application/json",
+			})).To(Equal([]string{"data_00001", "data_00003", "data_00005"}))
+
+			iter := bucket.List(&blob.ListOptions{BeforeList: func(as func(any) bool) error {
+				var listFilter *kodoblob.ListFilter
+				Expect(as(&listFilter)).To(BeTrue())
+				listFilter.MimeType = "image/["
+				return nil
+			}})
+			_, err := iter.Next(ctx)
+			Expect(err).To(MatchError(ContainSubstring("invalid MIME pattern")))
+		})
+
+		Context("ListParallel", func() {
+			var keys []string
+			BeforeEach(func() {
+				keys = []string{"data/file_0", "data/file_1", "data/z"}
+				for i := 0; i < 3; i++ {
+					for j := 0; j < 4; j++ {
+						for k := 0; k < 5; k++ {
+							keys = append(keys, fmt.Sprintf("data/dir_%d/sub_%d/file_%d", i, j, k))
+						}
+					}
+					keys = append(keys, fmt.Sprintf("data/dir_%d/file", i))
+				}
+				keys = append(keys, "data/dir_0-file", "other/file")
+				sort.Strings(keys)
+				rsfServer.SetHandler(mockListFiles(keys), 1000)
+			})
+
+			It("should list all files in parallel", func(ctx context.Context) {
+				var listed []string
+				err := kodoblob.ListParallel(ctx, bucket, "data/", 8, func(object *blob.ListObject) error {
+					Expect(object.IsDir).To(BeFalse())
+					Expect(object.Size).To(Equal(int64(len(object.Key))))
+					listed = append(listed, object.Key)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(listed).To(ConsistOf(keys[:len(keys)-1]))
+			})
+
+			It("should list all files in key order", func(ctx context.Context) {
+				for _, shards := range []int{1, 2, 4, 16} {
+					var listed []string
+					err := kodoblob.ListParallelInOrder(ctx, bucket, "data/", shards, func(object *blob.ListObject) error {
+						listed = append(listed, object.Key)
+						return nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(listed).To(Equal(keys[:len(keys)-1]))
+				}
+			})
+
+			It("should split flat keys by the keys after each page", func(ctx context.Context) {
+				for i := 0; i < 2500; i++ {
+					keys = append(keys, fmt.Sprintf("data/flat_%04d", i))
+				}
+				sort.Strings(keys)
+				var (
+					lock     sync.Mutex
+					prefixes = make(map[string]int)
+				)
+				listFiles := mockListFiles(keys)
+				rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+					lock.Lock()
+					prefixes[r.URL.Query().Get("prefix")]++
+					lock.Unlock()
+					listFiles(w, r, n)
+				}, 10000)
+
+				var listed []string
+				err := kodoblob.ListParallel(ctx, bucket, "data/", 8, func(object *blob.ListObject) error {
+					listed = append(listed, object.Key)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				sort.Strings(listed)
+				Expect(listed).To(Equal(keys[:len(keys)-1]))
+				// The first page ends in "data/flat_0993", the second page
+				// continues with the keys starting with "data/f" and ends in
+				// "data/flat_1993", the third page continues with the keys
+				// starting with "data/flat_1", and the keys after them are
+				// listed by the bytes which may follow in UTF-8.
+				Expect(prefixes).To(HaveKeyWithValue("data/", 3))
+				Expect(prefixes).To(HaveKeyWithValue("data/\xff", 1))
+				Expect(prefixes).To(HaveKeyWithValue("data/z", 1))
+				Expect(prefixes).To(HaveKeyWithValue("data/\xf4", 1))
+				Expect(prefixes).To(HaveKeyWithValue("data/flat_2", 1))
+				Expect(prefixes).To(HaveKeyWithValue("data/flat`", 1))
+				Expect(prefixes).To(HaveKeyWithValue("data/fm", 1))
+				Expect(prefixes).NotTo(HaveKey("data/\xc1"))
+				Expect(prefixes).NotTo(HaveKey("data/\xf5"))
+				Expect(prefixes).NotTo(HaveKey("data/f"))
+				Expect(prefixes).NotTo(HaveKey("data/flat_1"))
+				Expect(prefixes).NotTo(HaveKey("data/flat_0"))
+
+				for _, shards := range []int{1, 3, 16} {
+					listed = listed[:0]
+					err := kodoblob.ListParallelInOrder(ctx, bucket, "data/", shards, func(object *blob.ListObject) error {
+						listed = append(listed, object.Key)
+						return nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(listed).To(Equal(keys[:len(keys)-1]))
+				}
+			})
+
+			It("should split the ranges split from a range", func(ctx context.Context) {
+				for i := 0; i < 3000; i++ {
+					keys = append(keys, fmt.Sprintf("data/flat_%04d", i), fmt.Sprintf("data/flat_%04d_中", i))
+				}
+				sort.Strings(keys)
+				var (
+					lock     sync.Mutex
+					prefixes = make(map[string]int)
+				)
+				listFiles := mockListFiles(keys)
+				rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+					lock.Lock()
+					prefixes[r.URL.Query().Get("prefix")]++
+					lock.Unlock()
+					listFiles(w, r, n)
+				}, 100000)
+
+				var listed []string
+				err := kodoblob.ListParallel(ctx, bucket, "data/", 8, func(object *blob.ListObject) error {
+					listed = append(listed, object.Key)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				sort.Strings(listed)
+				Expect(listed).To(Equal(keys[:len(keys)-1]))
+				// "data/flat_2" split from "data/" has more than a page of
+				// entries, it is split again by the keys after its page.
+				Expect(prefixes).To(HaveKeyWithValue("data/flat_2", 2))
+				Expect(prefixes).To(HaveKeyWithValue("data/flat_25", 1))
+
+				for _, shards := range []int{1, 16} {
+					listed = listed[:0]
+					err := kodoblob.ListParallelInOrder(ctx, bucket, "data/", shards, func(object *blob.ListObject) error {
+						listed = append(listed, object.Key)
+						return nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(listed).To(Equal(keys[:len(keys)-1]))
+				}
+			})
+
+			It("should not split by bytes if the prefixes not in UTF-8 are rejected", func(ctx context.Context) {
+				for i := 0; i < 2500; i++ {
+					keys = append(keys, fmt.Sprintf("data/flat_%04d", i))
+				}
+				keys = append(keys, "data/中文")
+				sort.Strings(keys)
+				var (
+					lock     sync.Mutex
+					prefixes = make(map[string]int)
+				)
+				listFiles := mockListFiles(keys)
+				rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+					prefix := r.URL.Query().Get("prefix")
+					lock.Lock()
+					prefixes[prefix]++
+					lock.Unlock()
+					if !utf8.ValidString(prefix) {
+						w.WriteHeader(http.StatusBadRequest)
+						err := json.NewEncoder(w).Encode(map[string]any{"error": "invalid prefix"})
+						Expect(err).NotTo(HaveOccurred())
+						return
+					}
+					listFiles(w, r, n)
+				}, 10000)
+
+				var listed []string
+				err := kodoblob.ListParallel(ctx, bucket, "data/", 8, func(object *blob.ListObject) error {
+					listed = append(listed, object.Key)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				sort.Strings(listed)
+				Expect(listed).To(Equal(keys[:len(keys)-1]))
+				Expect(prefixes).To(HaveKeyWithValue("data/", 3))
+				Expect(prefixes).To(HaveKeyWithValue("data/\xff", 1))
+				Expect(prefixes).NotTo(HaveKey("data/z"))
+
+				listed = listed[:0]
+				err = kodoblob.ListParallelInOrder(ctx, bucket, "data/", 4, func(object *blob.ListObject) error {
+					listed = append(listed, object.Key)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(listed).To(Equal(keys[:len(keys)-1]))
+			})
+
+			It("should deliver objects while listing", func(ctx context.Context) {
+				var requests atomic.Int32
+				listFiles := mockListFiles(keys)
+				rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+					requests.Add(1)
+					listFiles(w, r, n)
+				}, 1000)
+
+				stopErr := errors.New("stop")
+				err := kodoblob.ListParallelInOrder(ctx, bucket, "data/", 4, func(object *blob.ListObject) error {
+					Expect(object.Key).To(Equal("data/dir_0-file"))
+					return stopErr
+				})
+				Expect(err).To(MatchError(stopErr))
+				Expect(requests.Load()).To(Equal(int32(1)))
+			})
+
+			It("should stop listing on error", func(ctx context.Context) {
+				stopErr := errors.New("stop")
+				count := 0
+				err := kodoblob.ListParallelInOrder(ctx, bucket, "data/", 4, func(object *blob.ListObject) error {
+					count += 1
+					if count == 10 {
+						return stopErr
+					}
+					return nil
+				})
+				Expect(err).To(MatchError(stopErr))
+				Expect(count).To(Equal(10))
+			})
+		})
+
 		It("should list all files with prefix", func(ctx context.Context) {
 			rsfServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
 				Expect(r.Method).To(Equal(http.MethodPost))
@@ -176,7 +530,7 @@ var _ = Describe("KodoBlob", func() {
 					items = append(items, map[string]any{
 						"key":      fmt.Sprintf("data_%05d", n*1000+i),
 						"hash":     fmt.Sprintf("hash_%05d", n*1000+i),
-						"md5":      fmt.Sprintf("md5_%05d", n*1000+i),
+						"md5":      fmt.Sprintf("%032x", n*1000+i),
 						"fsize":    n*1000 + i,
 						"mimeType": "text/plain",
 						"putTime":  time.Now().UnixNano() / 100,
@@ -250,6 +604,8 @@ var _ = Describe("KodoBlob", func() {
 				w.Header().Set("Last-Modified", time.Now().Format(time.RFC1123))
 				w.Header().Set("x-qn-meta-data-a", "value-1")
 				w.Header().Set("x-qn-meta-data-b", "value-2")
+				w.Header().Set("x-qn-meta-cache-control", "no-cache")
+				w.Header().Set("x-qn-meta-content-language", "zh-CN")
 			}, 1)
 			info, err := bucket.Attributes(ctx, "existed-file")
 			Expect(err).NotTo(HaveOccurred())
@@ -260,6 +616,9 @@ var _ = Describe("KodoBlob", func() {
 			Expect(info.ModTime).To(BeTemporally("~", time.Now(), 5*time.Second))
 			Expect(info.Metadata["data-a"]).To(Equal("value-1"))
 			Expect(info.Metadata["data-b"]).To(Equal("value-2"))
+			Expect(info.Metadata).To(HaveLen(2))
+			Expect(info.CacheControl).To(Equal("no-cache"))
+			Expect(info.ContentLanguage).To(Equal("zh-CN"))
 		})
 
 		It("should not get attributes from non-existed object", func(ctx context.Context) {
@@ -273,6 +632,7 @@ var _ = Describe("KodoBlob", func() {
 			_, err := bucket.Attributes(ctx, "non-existed")
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("kodoblob: unexpected status code 404"))
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.NotFound))
 		})
 	})
 
@@ -347,62 +707,8 @@ var _ = Describe("KodoBlob", func() {
 	Context("Upload", func() {
 		It("should upload object", func(ctx context.Context) {
 			blocks := [3][]byte{randData(4 * 1024 * 1024), randData(4 * 1024 * 1024), randData(4 * 1024 * 1024)}
-			upServer.WithMux(func(mux *http.ServeMux) {
-				bucketNameBase64ed := base64.URLEncoding.EncodeToString([]byte("existed-file"))
-				pathPrefix := "/buckets/" + bucketName + "/objects/" + bucketNameBase64ed + "/uploads"
-				called := uint32(0)
-				mux.HandleFunc(pathPrefix, func(w http.ResponseWriter, r *http.Request) {
-					n := atomic.AddUint32(&called, 1) - 1
-					path := strings.TrimPrefix(r.URL.Path, pathPrefix)
-					if path == "" || path == "/" {
-						Expect(r.Method).To(Equal(http.MethodPost))
-						w.Header().Set("Content-Type", "application/json")
-						err := json.NewEncoder(w).Encode(map[string]any{
-							"uploadId": "fakeuploadid",
-							"expireAt": time.Now().Unix(),
-						})
-						Expect(err).NotTo(HaveOccurred())
-						return
-					}
-					path = strings.TrimPrefix(path, "/fakeuploadid")
-					if path == "" || path == "/" {
-						Expect(r.Method).To(Equal(http.MethodPut))
-						type UploadPartInfo struct {
-							Etag       string `json:"etag"`
-							PartNumber int64  `json:"partNumber"`
-						}
-						var body struct {
-							Parts      []UploadPartInfo  `json:"parts"`
-							MimeType   string            `json:"mimeType,omitempty"`
-							Metadata   map[string]string `json:"metadata,omitempty"`
-							CustomVars map[string]string `json:"customVars,omitempty"`
-						}
-						err := json.NewDecoder(r.Body).Decode(&body)
-						Expect(err).NotTo(HaveOccurred())
-						Expect(body.MimeType).To(Equal("text/plain"))
-						Expect(body.Parts).To(HaveLen(3))
-						Expect(body.Parts[0]).To(Equal(UploadPartInfo{Etag: "fakeetag_1", PartNumber: 1}))
-						Expect(body.Parts[1]).To(Equal(UploadPartInfo{Etag: "fakeetag_2", PartNumber: 2}))
-						Expect(body.Parts[2]).To(Equal(UploadPartInfo{Etag: "fakeetag_3", PartNumber: 3}))
-						Expect(body.Metadata["data-a"]).To(Equal("value-1"))
-						Expect(body.Metadata["data-b"]).To(Equal("value-2"))
-						err = json.NewEncoder(w).Encode(map[string]any{})
-						Expect(err).NotTo(HaveOccurred())
-						return
-					}
-					path = strings.TrimPrefix(path, "/")
-					Expect(path).To(Equal(strconv.FormatUint(uint64(n), 10)))
-					Expect(r.Method).To(Equal(http.MethodPost))
-
-					var buf bytes.Buffer
-					contentLength, err := io.Copy(&buf, r.Body)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(contentLength).To(Equal(int64(len(blocks[n]))))
-					Expect(buf.Bytes()).To(Equal(blocks[n]))
-					err = json.NewEncoder(w).Encode(map[string]any{"etag": "fakeetag_" + path})
-					Expect(err).NotTo(HaveOccurred())
-				})
-			}, 5)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 5)
 
 			writer, err := bucket.NewWriter(ctx, "existed-file", &blob.WriterOptions{
 				ContentType: "text/plain",
@@ -419,6 +725,868 @@ var _ = Describe("KodoBlob", func() {
 
 			err = writer.Close()
 			Expect(err).NotTo(HaveOccurred())
+
+			completeBody := upload.CompleteBody()
+			Expect(completeBody.MimeType).To(Equal("text/plain"))
+			Expect(completeBody.Parts).To(HaveLen(3))
+			Expect(completeBody.Metadata["x-qn-meta-data-a"]).To(Equal("value-1"))
+			Expect(completeBody.Metadata["x-qn-meta-data-b"]).To(Equal("value-2"))
+			Expect(upload.Data()).To(Equal(bytes.Join(blocks[:], nil)))
+		})
+
+		It("should upload parts concurrently", func(ctx context.Context) {
+			data := randData(6 * 1024 * 1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upload.partDelay = 100 * time.Millisecond
+			upServer.WithMux(upload.Register, 8)
+
+			err := bucket.Upload(ctx, "existed-file", bytes.NewReader(data), &blob.WriterOptions{
+				ContentType:    "application/octet-stream",
+				BufferSize:     1024 * 1024,
+				MaxConcurrency: 3,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(upload.CompleteBody().Parts).To(HaveLen(6))
+			Expect(upload.MaxUploadingParts()).To(Equal(3))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should upload parts with bucket defaults", func(ctx context.Context) {
+			data := randData(3*1024*1024 + 1)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upload.partDelay = 100 * time.Millisecond
+			upServer.WithMux(upload.Register, 6)
+
+			bucket := newBucket("partSize", strconv.Itoa(1024*1024), "maxConcurrency", "2")
+			defer bucket.Close()
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{ContentType: "application/octet-stream"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(upload.CompleteBody().Parts).To(HaveLen(4))
+			Expect(upload.MaxUploadingParts()).To(Equal(2))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should verify ContentMD5 of uploaded file", func(ctx context.Context) {
+			tempDir, err := os.MkdirTemp("", "kodoblob-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tempDir)
+
+			data := randData(3 * 1024 * 1024)
+			path := filepath.Join(tempDir, "file.bin")
+			err = os.WriteFile(path, data, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			sum := md5.Sum(data)
+
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 5)
+
+			bucket := newBucket("partSize", strconv.Itoa(1024*1024))
+			defer bucket.Close()
+			err = kodoblob.UploadFile(ctx, bucket, "existed-file", path, &blob.WriterOptions{ContentMD5: sum[:]})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upload.Completed()).To(BeTrue())
+			Expect(upload.Data()).To(Equal(data))
+
+			// The mismatches are detected before uploading, any request fails
+			// the mock server.
+			wrongSum := md5.Sum(data[1:])
+			err = kodoblob.UploadFile(ctx, bucket, "existed-file", path, &blob.WriterOptions{ContentMD5: wrongSum[:]})
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.FailedPrecondition))
+			err = kodoblob.UploadReaderAt(ctx, bucket, "existed-file", bytes.NewReader(data), int64(len(data)), &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				ContentMD5:  wrongSum[:],
+			})
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.FailedPrecondition))
+			err = kodoblob.UploadReaderAt(ctx, bucket, "existed-file", bytes.NewReader(data), -1, &blob.WriterOptions{ContentType: "application/octet-stream"})
+			Expect(err).To(MatchError(kodoblob.ErrNegativeSize))
+			Expect(kodoblob.ErrorCode(err)).To(Equal(gcerrors.InvalidArgument))
+
+			// Bucket.Upload does not verify ContentMD5 for the sources of
+			// known sizes, but the object is never committed with an error.
+			err = bucket.Upload(ctx, "existed-file", io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				ContentMD5:  sum[:],
+			})
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.FailedPrecondition))
+		})
+
+		It("should resume file upload from recorder", func(ctx context.Context) {
+			tempDir, err := os.MkdirTemp("", "kodoblob-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tempDir)
+
+			data := randData(3 * 1024 * 1024)
+			path := filepath.Join(tempDir, "file.bin")
+			err = os.WriteFile(path, data, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			recorderDir := filepath.Join(tempDir, "recorder")
+
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upload.partStatus = func(partNumber int64) int {
+				if partNumber == 3 && !upload.Completed() {
+					if _, partUploads := upload.Requests(); partUploads <= 3 {
+						return http.StatusBadRequest
+					}
+				}
+				return 0
+			}
+			upServer.WithMux(upload.Register, 6)
+
+			bucket := newBucket("partSize", strconv.Itoa(1024*1024), "recorderDir", recorderDir)
+			defer bucket.Close()
+			err = kodoblob.UploadFile(ctx, bucket, "existed-file", path, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(upload.Completed()).To(BeFalse())
+			records, err := os.ReadDir(recorderDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records).To(HaveLen(1))
+
+			err = kodoblob.UploadFile(ctx, bucket, "existed-file", path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			initiates, partUploads := upload.Requests()
+			Expect(initiates).To(Equal(1))
+			Expect(partUploads).To(Equal(4))
+			Expect(upload.CompleteBody().MimeType).To(Equal("application/octet-stream"))
+			Expect(upload.Data()).To(Equal(data))
+			records, err = os.ReadDir(recorderDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records).To(BeEmpty())
+		})
+
+		It("should apply write options to upload policy", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 3)
+
+			bucket := newBucket("fileType", "1", "deleteAfterDays", "30", "endUser", "user-a", "mimeLimit", "image/*")
+			defer bucket.Close()
+			err := bucket.WriteAll(ctx, "existed-file", randData(1024), &blob.WriterOptions{
+				ContentType: "image/png",
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					Expect(asFunc(&writeOptions)).To(BeTrue())
+					writeOptions.InsertOnly = true
+					writeOptions.FileType = 2
+					writeOptions.PersistentOps = "avthumb/mp4"
+					writeOptions.PersistentPipeline = "pipeline-a"
+					var putPolicy *storage.PutPolicy
+					Expect(asFunc(&putPolicy)).To(BeTrue())
+					putPolicy.TrafficLimit = 819200
+					return nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			putPolicy := decodePutPolicy(upload.UpToken())
+			Expect(putPolicy["scope"]).To(Equal(bucketName + ":existed-file"))
+			Expect(putPolicy["insertOnly"]).To(BeEquivalentTo(1))
+			Expect(putPolicy["fileType"]).To(BeEquivalentTo(2))
+			Expect(putPolicy["deleteAfterDays"]).To(BeEquivalentTo(30))
+			Expect(putPolicy["endUser"]).To(Equal("user-a"))
+			Expect(putPolicy["mimeLimit"]).To(Equal("image/*"))
+			Expect(putPolicy["persistentOps"]).To(Equal("avthumb/mp4"))
+			Expect(putPolicy["persistentPipeline"]).To(Equal("pipeline-a"))
+			Expect(putPolicy["trafficLimit"]).To(BeEquivalentTo(819200))
+			Expect(putPolicy).NotTo(HaveKey("detectMime"))
+		})
+
+		It("should parse boolean write options", func(ctx context.Context) {
+			for i, test := range []struct {
+				options      []string
+				insertOnly   bool
+				detectMime   bool
+				forceSaveKey bool
+			}{
+				{[]string{"insertOnly", "false", "detectMime", "0", "saveKey", "files/$(etag)", "forceSaveKey", "false"}, false, false, false},
+				{[]string{"insertOnly", "", "detectMime", "true", "saveKey", "files/$(etag)", "forceSaveKey", ""}, true, true, true},
+			} {
+				upload := newMockMultipartUpload(bucketName, "existed-file")
+				upServer.WithMux(upload.Register, uint32(i+1))
+				bucket := newBucket(test.options...)
+				err := bucket.WriteAll(ctx, "existed-file", randData(1024), nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bucket.Close()).To(Succeed())
+
+				putPolicy := decodePutPolicy(upload.UpToken())
+				Expect(putPolicy["insertOnly"] == nil).To(Equal(!test.insertOnly))
+				Expect(putPolicy["detectMime"] == nil).To(Equal(!test.detectMime))
+				Expect(putPolicy["forceSaveKey"] == true).To(Equal(test.forceSaveKey))
+				Expect(upload.SavedKey() == "existed-file").To(Equal(!test.forceSaveKey))
+			}
+
+			values := url.Values{"insertOnly": {"yes"}}
+			_, err := blob.OpenBucket(ctx, "kodo://"+accessKey+":"+secretKey+"@"+bucketName+"?"+values.Encode())
+			Expect(err).To(MatchError(ContainSubstring("invalid insertOnly")))
+			values = url.Values{"forceSaveKey": {"yes"}}
+			_, err = blob.OpenBucket(ctx, "kodo://"+accessKey+":"+secretKey+"@"+bucketName+"?"+values.Encode())
+			Expect(err).To(MatchError(ContainSubstring("invalid forceSaveKey")))
+		})
+
+		It("should not overwrite existed object in insert-only mode", func(ctx context.Context) {
+			data := randData(1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 6)
+
+			insertOnly := func(asFunc func(interface{}) bool) error {
+				var writeOptions *kodoblob.WriteOptions
+				Expect(asFunc(&writeOptions)).To(BeTrue())
+				writeOptions.InsertOnly = true
+				return nil
+			}
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{BeforeWrite: insertOnly})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(upload.FormUploads()).To(Equal(1))
+
+			err = bucket.WriteAll(ctx, "existed-file", randData(1024*1024+1), &blob.WriterOptions{
+				BufferSize:  1024 * 1024,
+				BeforeWrite: insertOnly,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.AlreadyExists))
+			Expect(upload.Data()).To(Equal(data))
+			Expect(upload.Aborted()).To(BeTrue())
+		})
+
+		It("should upload small object in a single form upload", func(ctx context.Context) {
+			data := randData(200)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 1)
+
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/json",
+				Metadata:    map[string]string{"data-a": "value-1"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			initiates, _ := upload.Requests()
+			Expect(initiates).To(BeZero())
+			Expect(upload.FormUploads()).To(Equal(1))
+			Expect(upload.CompleteBody().MimeType).To(Equal("application/json"))
+			Expect(upload.CompleteBody().Metadata).To(Equal(map[string]string{"x-qn-meta-data-a": "value-1"}))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should upload object larger than form upload threshold in parts", func(ctx context.Context) {
+			data := randData(1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 3)
+
+			bucket := newBucket("formUploadThreshold", "512")
+			defer bucket.Close()
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{ContentType: "application/octet-stream"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(upload.FormUploads()).To(BeZero())
+			Expect(upload.CompleteBody().Parts).To(HaveLen(1))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should upload io.ReaderAt in parts", func(ctx context.Context) {
+			data := randData(3*1024*1024 + 1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 6)
+
+			bucket := newBucket("partSize", strconv.Itoa(1024*1024))
+			defer bucket.Close()
+			err := kodoblob.UploadReaderAt(ctx, bucket, "existed-file", bytes.NewReader(data), int64(len(data)), &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				Metadata:    map[string]string{"data-a": "value-1"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			completeBody := upload.CompleteBody()
+			Expect(completeBody.Parts).To(HaveLen(4))
+			Expect(completeBody.Metadata["x-qn-meta-data-a"]).To(Equal("value-1"))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should report upload progress", func(ctx context.Context) {
+			data := randData(2*1024*1024 + 1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 5)
+
+			var progresses []kodoblob.Progress
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					if asFunc(&writeOptions) {
+						writeOptions.OnProgress = func(progress kodoblob.Progress) {
+							progresses = append(progresses, progress)
+						}
+					}
+					return nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(progresses).To(HaveLen(3))
+			for _, progress := range progresses {
+				Expect(progress.UpHost).To(Equal(upServer.URL()))
+			}
+			last := progresses[len(progresses)-1]
+			Expect(last.UploadedBytes).To(Equal(int64(len(data))))
+			Expect(last.UploadedParts).To(Equal(3))
+			Expect(last.TotalBytes).To(Equal(int64(len(data))))
+		})
+
+		It("should report progress of io.ReaderAt and form upload", func(ctx context.Context) {
+			data := randData(3*1024*1024 + 1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 7)
+
+			bucket := newBucket("partSize", strconv.Itoa(1024*1024))
+			defer bucket.Close()
+			var (
+				progresses []kodoblob.Progress
+				opts       = &blob.WriterOptions{
+					ContentType: "application/octet-stream",
+					BeforeWrite: func(asFunc func(interface{}) bool) error {
+						var writeOptions *kodoblob.WriteOptions
+						if asFunc(&writeOptions) {
+							writeOptions.OnProgress = func(progress kodoblob.Progress) {
+								progresses = append(progresses, progress)
+							}
+						}
+						return nil
+					},
+				}
+			)
+			err := kodoblob.UploadReaderAt(ctx, bucket, "existed-file", bytes.NewReader(data), int64(len(data)), opts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progresses).To(HaveLen(4))
+			Expect(progresses[3]).To(Equal(kodoblob.Progress{UploadedBytes: int64(len(data)), UploadedParts: 4, TotalBytes: int64(len(data)), UpHost: upServer.URL()}))
+
+			progresses = nil
+			err = bucket.WriteAll(ctx, "existed-file", data[:200], opts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progresses).To(Equal([]kodoblob.Progress{{UploadedBytes: 200, TotalBytes: 200, UpHost: upServer.URL()}}))
+		})
+
+		It("should return the custom return body", func(ctx context.Context) {
+			data := randData(200)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 1)
+
+			var results []kodoblob.UploadResult
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					if asFunc(&writeOptions) {
+						writeOptions.ReturnBody = `{"key":"$(key)","hash":"$(etag)","size":$(fsize)}`
+						writeOptions.OnComplete = func(result kodoblob.UploadResult) {
+							results = append(results, result)
+						}
+					}
+					return nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Key).To(Equal("existed-file"))
+			Expect(results[0].Hash).To(Equal(upload.Hash()))
+			Expect(results[0].Body).To(MatchJSON(fmt.Sprintf(`{"key":"existed-file","hash":%q,"size":200}`, upload.Hash())))
+		})
+
+		It("should return the callback response", func(ctx context.Context) {
+			callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				body, err := io.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(body).To(MatchJSON(`{"key":"existed-file","size":2097152}`))
+				w.Header().Set("Content-Type", "application/json")
+				_, err = w.Write([]byte(`{"id":42}`))
+				Expect(err).NotTo(HaveOccurred())
+			}))
+			defer callbackServer.Close()
+
+			data := randData(2 * 1024 * 1024)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 4)
+
+			bucket := newBucket(
+				"callbackUrl", callbackServer.URL,
+				"callbackBody", `{"key":"$(key)","size":$(fsize)}`,
+				"callbackBodyType", "application/json",
+			)
+			defer bucket.Close()
+			var results []kodoblob.UploadResult
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					if asFunc(&writeOptions) {
+						writeOptions.OnComplete = func(result kodoblob.UploadResult) {
+							results = append(results, result)
+						}
+					}
+					return nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			putPolicy := decodePutPolicy(upload.UpToken())
+			Expect(putPolicy["callbackUrl"]).To(Equal(callbackServer.URL))
+			Expect(upload.CompleteBody().Parts).To(HaveLen(2))
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Key).To(BeEmpty())
+			Expect(results[0].Body).To(MatchJSON(`{"id":42}`))
+		})
+
+		It("should fail if the hash of the uploaded object mismatches", func(ctx context.Context) {
+			data := randData(2*1024*1024 + 1)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upload.hash = "Fto5o-5ea0sNMlW_75VgGJCv2AcJ"
+			upServer.WithMux(upload.Register, 6)
+
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+			})
+			Expect(err).To(MatchError(kodoblob.ErrEtagMismatch))
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.Internal))
+
+			err = kodoblob.UploadReaderAt(ctx, bucket, "existed-file", bytes.NewReader(data[:100]), 100, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+			})
+			Expect(err).To(MatchError(kodoblob.ErrEtagMismatch))
+		})
+
+		It("should save object with the key generated by Kodo", func(ctx context.Context) {
+			data := randData(2 * 1024 * 1024)
+			upload := newMockMultipartUpload(bucketName, "")
+			upServer.WithMux(upload.Register, 4)
+
+			bucket := newBucket("saveKey", "files/$(etag)")
+			defer bucket.Close()
+			var results []kodoblob.UploadResult
+			err := bucket.WriteAll(ctx, "", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					if asFunc(&writeOptions) {
+						writeOptions.OnComplete = func(result kodoblob.UploadResult) {
+							results = append(results, result)
+						}
+					}
+					return nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(upload.CompleteBody().Parts).To(HaveLen(2))
+			Expect(decodePutPolicy(upload.UpToken())["scope"]).To(Equal(bucketName))
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Key).To(Equal("files/" + upload.Hash()))
+			Expect(upload.SavedKey()).To(Equal(results[0].Key))
+		})
+
+		It("should overwrite named object with the default save key", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 2)
+
+			bucket := newBucket("saveKey", "files/$(etag)")
+			defer bucket.Close()
+			for i := 0; i < 2; i++ {
+				data := randData(200)
+				err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{ContentType: "application/octet-stream"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upload.Data()).To(Equal(data))
+			}
+
+			Expect(upload.FormUploads()).To(Equal(2))
+			Expect(decodePutPolicy(upload.UpToken())["scope"]).To(Equal(bucketName + ":existed-file"))
+			Expect(upload.SavedKey()).To(Equal("existed-file"))
+		})
+
+		It("should force saving object with the key generated by Kodo", func(ctx context.Context) {
+			data := randData(200)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 1)
+
+			var results []kodoblob.UploadResult
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					if asFunc(&writeOptions) {
+						writeOptions.SaveKey = "files/$(etag)"
+						writeOptions.ForceSaveKey = true
+						writeOptions.OnComplete = func(result kodoblob.UploadResult) {
+							results = append(results, result)
+						}
+					}
+					return nil
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(upload.FormUploads()).To(Equal(1))
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Key).To(Equal("files/" + upload.Hash()))
+		})
+
+		It("should upload small file in a single form upload", func(ctx context.Context) {
+			tempDir, err := os.MkdirTemp("", "kodoblob-test-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tempDir)
+
+			data := []byte(`{"hello":"world"}`)
+			path := filepath.Join(tempDir, "file.json")
+			err = os.WriteFile(path, data, 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 1)
+
+			err = kodoblob.UploadFile(ctx, bucket, "existed-file", path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upload.FormUploads()).To(Equal(1))
+			Expect(upload.CompleteBody().MimeType).To(Equal("application/json"))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should persist standard headers", func(ctx context.Context) {
+			data := randData(1024)
+			contentMD5 := md5.Sum(data)
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 3)
+
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType:        "text/plain",
+				CacheControl:       "no-cache",
+				ContentDisposition: "attachment; filename=\"a.txt\"",
+				ContentEncoding:    "gzip",
+				ContentLanguage:    "zh-CN",
+				ContentMD5:         contentMD5[:],
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			completeBody := upload.CompleteBody()
+			Expect(completeBody.Metadata["x-qn-meta-cache-control"]).To(Equal("no-cache"))
+			Expect(completeBody.Metadata["x-qn-meta-content-disposition"]).To(Equal("attachment; filename=\"a.txt\""))
+			Expect(completeBody.Metadata["x-qn-meta-content-encoding"]).To(Equal("gzip"))
+			Expect(completeBody.Metadata["x-qn-meta-content-language"]).To(Equal("zh-CN"))
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should not complete upload if ContentMD5 mismatches", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 3)
+
+			writer, err := bucket.NewWriter(ctx, "existed-file", &blob.WriterOptions{
+				ContentType: "text/plain",
+				ContentMD5:  make([]byte, md5.Size),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = writer.Write(randData(1024))
+			Expect(err).NotTo(HaveOccurred())
+			err = writer.Close()
+			Expect(err).To(HaveOccurred())
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.FailedPrecondition))
+			Expect(upload.Completed()).To(BeFalse())
+		})
+
+		It("should abort upload if context is canceled before close", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 3)
+
+			writeCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			writer, err := bucket.NewWriter(writeCtx, "existed-file", &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = writer.Write(randData(1024*1024 + 1024))
+			Expect(err).NotTo(HaveOccurred())
+
+			cancel()
+			err = writer.Close()
+			Expect(err).To(HaveOccurred())
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.Canceled))
+			Expect(upload.Completed()).To(BeFalse())
+			Expect(upload.Aborted()).To(BeTrue())
+		})
+
+		It("should abort upload of io.ReaderAt if context is canceled", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 5)
+
+			bucket := newBucket("partSize", strconv.Itoa(1024*1024))
+			defer bucket.Close()
+			uploadCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			data := randData(3 * 1024 * 1024)
+			err := kodoblob.UploadReaderAt(uploadCtx, bucket, "existed-file", bytes.NewReader(data), int64(len(data)), &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BeforeWrite: func(asFunc func(interface{}) bool) error {
+					var writeOptions *kodoblob.WriteOptions
+					if asFunc(&writeOptions) {
+						writeOptions.OnProgress = func(kodoblob.Progress) {
+							cancel()
+						}
+					}
+					return nil
+				},
+			})
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.Canceled))
+			Expect(upload.Completed()).To(BeFalse())
+			Expect(upload.Aborted()).To(BeTrue())
+		})
+
+		It("should return the first part error and abort upload", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upload.partStatus = func(partNumber int64) int {
+				if partNumber == 2 {
+					return http.StatusBadRequest
+				}
+				return 0
+			}
+			upServer.WithMux(upload.Register, 5)
+
+			writer, err := bucket.NewWriter(ctx, "existed-file", &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = writer.Write(randData(3 * 1024 * 1024))
+			if err != nil {
+				Expect(gcerrors.Code(err)).To(Equal(gcerrors.InvalidArgument))
+			}
+			err = writer.Close()
+			Expect(err).To(HaveOccurred())
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.InvalidArgument))
+			Expect(upload.Completed()).To(BeFalse())
+			Expect(upload.Aborted()).To(BeTrue())
+		})
+
+		It("should fail over to the next upload host and freeze the failed one", func(ctx context.Context) {
+			failedServer := newMockServerWithHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				err := json.NewEncoder(w).Encode(map[string]any{"error": "mock service unavailable"})
+				Expect(err).NotTo(HaveOccurred())
+			}, 1)
+			defer failedServer.Close()
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 2)
+
+			bucket := newBucket(
+				"upHostType", "src",
+				"srcUpHost", failedServer.URL(),
+				"cdnUpHost", upServer.URL(),
+				"uploadRetryInterval", "1ms",
+			)
+			defer bucket.Close()
+			for i := 0; i < 2; i++ {
+				err := bucket.WriteAll(ctx, "existed-file", randData(200), &blob.WriterOptions{ContentType: "application/octet-stream"})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(upload.FormUploads()).To(Equal(2))
+		})
+
+		It("should fail over to the next upload host without freezing", func(ctx context.Context) {
+			failedServer := newMockServerWithHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				err := json.NewEncoder(w).Encode(map[string]any{"error": "mock service unavailable"})
+				Expect(err).NotTo(HaveOccurred())
+			}, 2)
+			defer failedServer.Close()
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 2)
+
+			bucket := newBucket(
+				"upHostType", "src",
+				"srcUpHost", failedServer.URL(),
+				"cdnUpHost", upServer.URL(),
+				"uploadRetryInterval", "1ms",
+				"hostFreezeDuration", "0s",
+			)
+			defer bucket.Close()
+			for i := 0; i < 2; i++ {
+				err := bucket.WriteAll(ctx, "existed-file", randData(200), &blob.WriterOptions{ContentType: "application/octet-stream"})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(upload.FormUploads()).To(Equal(2))
+		})
+
+		It("should upload to transfer acceleration hosts first", func(ctx context.Context) {
+			upload := newMockMultipartUpload(bucketName, "existed-file")
+			upServer.WithMux(upload.Register, 4)
+
+			bucket := newBucket("upHostType", "acc", "accUpHost", upServer.URL(), "srcUpHost", "http://127.0.0.1:1")
+			defer bucket.Close()
+			data := randData(2 * 1024 * 1024)
+			err := bucket.WriteAll(ctx, "existed-file", data, &blob.WriterOptions{
+				ContentType: "application/octet-stream",
+				BufferSize:  1024 * 1024,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upload.Data()).To(Equal(data))
+		})
+
+		It("should give up after the upload try times", func(ctx context.Context) {
+			upServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				err := json.NewEncoder(w).Encode(map[string]any{"error": "mock service unavailable"})
+				Expect(err).NotTo(HaveOccurred())
+			}, 2)
+
+			bucket := newBucket("srcUpHost", upServer.URL(), "uploadTryTimes", "2", "uploadRetryInterval", "1ms")
+			defer bucket.Close()
+			err := bucket.WriteAll(ctx, "existed-file", randData(200), &blob.WriterOptions{ContentType: "application/octet-stream"})
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.Internal))
+		})
+
+		It("should reject invalid upload host and retry options", func(ctx context.Context) {
+			for _, options := range [][]string{
+				{"upHostType", "unknown"},
+				{"upHostType", "acc"},
+				{"uploadTryTimes", "0"},
+				{"uploadRetryInterval", "1"},
+				{"hostFreezeDuration", "-1s"},
+			} {
+				values := url.Values{options[0]: {options[1]}}
+				_, err := blob.OpenBucket(ctx, "kodo://"+accessKey+":"+secretKey+"@"+bucketName+"?"+values.Encode())
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+
+	Context("SignedURL", func() {
+		It("should sign url for PUT", func(ctx context.Context) {
+			s3Server := newMockServerWithHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				Expect(r.Method).To(Equal(http.MethodPut))
+				Expect(r.URL.Path).To(Equal("/" + bucketName + "/dir/existed-file"))
+				Expect(r.URL.Query().Get("X-Amz-Algorithm")).To(Equal("AWS4-HMAC-SHA256"))
+				Expect(r.URL.Query().Get("X-Amz-Credential")).To(HavePrefix(accessKey + "/"))
+				Expect(r.URL.Query().Get("X-Amz-Credential")).To(HaveSuffix("/cn-east-1/s3/aws4_request"))
+				Expect(r.URL.Query().Get("X-Amz-Expires")).To(Equal("3600"))
+				Expect(r.URL.Query().Get("X-Amz-SignedHeaders")).To(Equal("content-type;host"))
+				Expect(r.URL.Query().Get("X-Amz-Signature")).To(HaveLen(64))
+				Expect(r.Header.Get("Content-Type")).To(Equal("text/plain"))
+			}, 1)
+			defer s3Server.Close()
+
+			values := make(url.Values)
+			values.Set("bucketHost", ucServer.URL())
+			values.Set("s3Endpoint", s3Server.URL())
+			values.Set("s3Region", "cn-east-1")
+			bucket, err := blob.OpenBucket(ctx, "kodo://"+accessKey+":"+secretKey+"@"+bucketName+"?"+values.Encode())
+			Expect(err).NotTo(HaveOccurred())
+			defer bucket.Close()
+
+			signedUrl, err := bucket.SignedURL(ctx, "dir/existed-file", &blob.SignedURLOptions{
+				Method:      http.MethodPut,
+				Expiry:      time.Hour,
+				ContentType: "text/plain",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			request, err := http.NewRequestWithContext(ctx, http.MethodPut, signedUrl, strings.NewReader("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Content-Type", "text/plain")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should sign url for DELETE with endpoint derived from bucket region", func(ctx context.Context) {
+			signedUrl, err := bucket.SignedURL(ctx, "existed-file", &blob.SignedURLOptions{
+				Method: http.MethodDelete,
+				Expiry: time.Hour,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			u, err := url.Parse(signedUrl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Host).To(Equal("s3.cn-east-1.qiniucs.com"))
+			Expect(u.Path).To(Equal("/" + bucketName + "/existed-file"))
+			Expect(u.Query().Get("X-Amz-SignedHeaders")).To(Equal("host"))
+		})
+
+		It("should not query bucket region after cancellation", func(ctx context.Context) {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := bucket.SignedURL(ctx, "existed-file", &blob.SignedURLOptions{
+				Method: http.MethodDelete,
+				Expiry: time.Hour,
+			})
+			Expect(err).To(MatchError(context.Canceled))
+		})
+
+		It("should enforce absent content type for PUT", func(ctx context.Context) {
+			signedUrl, err := bucket.SignedURL(ctx, "existed-file", &blob.SignedURLOptions{
+				Method:                   http.MethodPut,
+				Expiry:                   time.Hour,
+				EnforceAbsentContentType: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			u, err := url.Parse(signedUrl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Query().Get("X-Amz-SignedHeaders")).To(Equal("content-type;host"))
+		})
+	})
+
+	Context("FormUpload", func() {
+		It("should sign form upload for key", func(ctx context.Context) {
+			formUpload, err := kodoblob.SignFormUpload(ctx, bucket, &kodoblob.FormUploadOptions{
+				Key:        "existed-file",
+				Expiry:     10 * time.Minute,
+				InsertOnly: true,
+				FsizeLimit: 1024,
+				MimeLimit:  "image/*",
+				ReturnBody: `{"key":$(key),"hash":$(etag)}`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(formUpload.URL).To(Equal("http://" + upServer.Host()))
+			Expect(formUpload.Fields).To(Equal(map[string]string{"token": formUpload.Token, "key": "existed-file"}))
+			Expect(formUpload.Expiry).To(BeTemporally("~", time.Now().Add(10*time.Minute), 5*time.Second))
+
+			putPolicy := decodePutPolicy(formUpload.Token)
+			Expect(putPolicy["scope"]).To(Equal(bucketName + ":existed-file"))
+			Expect(putPolicy["insertOnly"]).To(BeEquivalentTo(1))
+			Expect(putPolicy["fsizeLimit"]).To(BeEquivalentTo(1024))
+			Expect(putPolicy["mimeLimit"]).To(Equal("image/*"))
+			Expect(putPolicy["returnBody"]).To(Equal(`{"key":$(key),"hash":$(etag)}`))
+			Expect(putPolicy["deadline"]).To(BeNumerically("~", time.Now().Add(10*time.Minute).Unix(), 5))
+		})
+
+		It("should sign form upload for prefix", func(ctx context.Context) {
+			formUpload, err := kodoblob.SignFormUpload(ctx, bucket, &kodoblob.FormUploadOptions{
+				Key:              "uploads/",
+				IsPrefixalScope:  true,
+				CallbackURL:      "http://callback.example.com/callback",
+				CallbackBody:     `{"key":"$(key)"}`,
+				CallbackBodyType: "application/json",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(formUpload.Fields).To(Equal(map[string]string{"token": formUpload.Token}))
+
+			putPolicy := decodePutPolicy(formUpload.Token)
+			Expect(putPolicy["scope"]).To(Equal(bucketName + ":uploads/"))
+			Expect(putPolicy["isPrefixalScope"]).To(BeEquivalentTo(1))
+			Expect(putPolicy["callbackUrl"]).To(Equal("http://callback.example.com/callback"))
+			Expect(putPolicy["callbackBody"]).To(Equal(`{"key":"$(key)"}`))
+			Expect(putPolicy["callbackBodyType"]).To(Equal("application/json"))
+			Expect(putPolicy["deadline"]).To(BeNumerically("~", time.Now().Add(time.Hour).Unix(), 5))
+		})
+
+		It("should not sign form upload after cancellation", func(ctx context.Context) {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := kodoblob.SignFormUpload(ctx, bucket, nil)
+			Expect(err).To(MatchError(context.Canceled))
 		})
 	})
 
@@ -433,6 +1601,442 @@ var _ = Describe("KodoBlob", func() {
 			err := bucket.Copy(ctx, "dst-file", "src-file", nil)
 			Expect(err).NotTo(HaveOccurred())
 		})
+
+		It("should not overwrite existing object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, _ uint32) {
+				Expect(r.URL.Path).To(HaveSuffix("/force/false"))
+				w.WriteHeader(614)
+			}, 1)
+			err := bucket.Copy(ctx, "dst-file", "src-file", &blob.CopyOptions{BeforeCopy: func(as func(any) bool) error {
+				var copyOptions *kodoblob.CopyOptions
+				Expect(as(&copyOptions)).To(BeTrue())
+				copyOptions.NoOverwrite = true
+				return nil
+			}})
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.AlreadyExists))
+		})
+
+		It("should succeed if the failed attempt has copied object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				switch n {
+				case 0:
+					w.WriteHeader(http.StatusBadGateway)
+				case 1:
+					w.WriteHeader(614)
+				case 2:
+					Expect(r.URL.Path).To(Equal("/stat/" + base64.URLEncoding.EncodeToString([]byte(bucketName+":src-file"))))
+					Expect(json.NewEncoder(w).Encode(map[string]any{"hash": "hash"})).To(Succeed())
+				case 3:
+					Expect(r.URL.Path).To(Equal("/stat/" + base64.URLEncoding.EncodeToString([]byte(bucketName+":dst-file"))))
+					Expect(json.NewEncoder(w).Encode(map[string]any{"hash": "hash"})).To(Succeed())
+				}
+			}, 4)
+			bucket := newBucket("uploadRetryInterval", "1ms")
+			defer bucket.Close()
+			err := bucket.Copy(ctx, "dst-file", "src-file", &blob.CopyOptions{BeforeCopy: func(as func(any) bool) error {
+				var copyOptions *kodoblob.CopyOptions
+				Expect(as(&copyOptions)).To(BeTrue())
+				copyOptions.NoOverwrite = true
+				return nil
+			}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should replace metadata and storage class of the copy", func(ctx context.Context) {
+			objectNameDstBase64ed := base64.URLEncoding.EncodeToString([]byte(bucketName + ":dst-file"))
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				switch n {
+				case 0:
+					Expect(r.URL.Path).To(HaveSuffix("/force/true"))
+				case 1:
+					Expect(r.URL.Path).To(Equal("/chgm/" + objectNameDstBase64ed +
+						"/mime/" + base64.URLEncoding.EncodeToString([]byte("text/plain")) +
+						"/x-qn-meta-name/" + base64.URLEncoding.EncodeToString([]byte("value"))))
+				case 2:
+					Expect(r.URL.Path).To(Equal("/chtype/" + objectNameDstBase64ed + "/type/2"))
+				}
+			}, 3)
+			err := bucket.Copy(ctx, "dst-file", "src-file", &blob.CopyOptions{BeforeCopy: func(as func(any) bool) error {
+				var copyOptions *kodoblob.CopyOptions
+				Expect(as(&copyOptions)).To(BeTrue())
+				fileType := 2
+				copyOptions.ContentType = "text/plain"
+				copyOptions.Metadata = map[string]string{"name": "value"}
+				copyOptions.FileType = &fileType
+				return nil
+			}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should retry copying object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				if n == 0 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}, 2)
+			bucket := newBucket("uploadRetryInterval", "1ms")
+			defer bucket.Close()
+			err := bucket.Copy(ctx, "dst-file", "src-file", nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should abort copying object on cancellation", func(ctx context.Context) {
+			aborted := make(chan struct{})
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, _ uint32) {
+				<-r.Context().Done()
+				close(aborted)
+			}, 1)
+			ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer cancel()
+			err := bucket.Copy(ctx, "dst-file", "src-file", nil)
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.DeadlineExceeded))
+			Eventually(aborted).Should(BeClosed())
+		})
+	})
+
+	Context("Move", func() {
+		It("should move object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, _ uint32) {
+				objectNameSrcBase64ed := base64.URLEncoding.EncodeToString([]byte(bucketName + ":src-file"))
+				objectNameDstBase64ed := base64.URLEncoding.EncodeToString([]byte(bucketName + ":dst-file"))
+				Expect(r.Method).To(Equal(http.MethodPost))
+				Expect(r.URL.Path).To(Equal("/move/" + objectNameSrcBase64ed + "/" + objectNameDstBase64ed + "/force/true"))
+			}, 1)
+			err := kodoblob.Move(ctx, bucket, "src-file", "dst-file", true)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should not overwrite existing object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, _ uint32) {
+				Expect(r.URL.Path).To(HaveSuffix("/force/false"))
+				w.WriteHeader(614)
+			}, 1)
+			err := kodoblob.Move(ctx, bucket, "src-file", "dst-file", false)
+			Expect(kodoblob.ErrorCode(err)).To(Equal(gcerrors.AlreadyExists))
+		})
+	})
+
+	Context("CopyBetween", func() {
+		const otherBucketName = "otherbucketname"
+		openOtherBucket := func(accessKey string) *blob.Bucket {
+			values := url.Values{"rsHost": {rsServer.URL()}, "uploadRetryInterval": {"1ms"}}
+			bucket, err := blob.OpenBucket(context.Background(), "kodo://"+accessKey+":"+secretKey+"@"+otherBucketName+"?"+values.Encode())
+			Expect(err).NotTo(HaveOccurred())
+			return bucket
+		}
+
+		It("should copy object to another bucket", func(ctx context.Context) {
+			objectNameDstBase64ed := base64.URLEncoding.EncodeToString([]byte(otherBucketName + ":dst-file"))
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				switch n {
+				case 0:
+					objectNameSrcBase64ed := base64.URLEncoding.EncodeToString([]byte(bucketName + ":src-file"))
+					Expect(r.URL.Path).To(Equal("/copy/" + objectNameSrcBase64ed + "/" + objectNameDstBase64ed + "/force/false"))
+				case 1:
+					Expect(r.URL.Path).To(Equal("/chgm/" + objectNameDstBase64ed + "/mime/" + base64.URLEncoding.EncodeToString([]byte("text/plain"))))
+				}
+			}, 2)
+			otherBucket := openOtherBucket(accessKey)
+			defer otherBucket.Close()
+			err := kodoblob.CopyBetween(ctx, bucket, "src-file", otherBucket, "dst-file", &kodoblob.CopyOptions{NoOverwrite: true, ContentType: "text/plain"})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should move object to another bucket", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				objectNameSrcBase64ed := base64.URLEncoding.EncodeToString([]byte(otherBucketName + ":src-file"))
+				objectNameDstBase64ed := base64.URLEncoding.EncodeToString([]byte(bucketName + ":dst-file"))
+				Expect(r.URL.Path).To(Equal("/move/" + objectNameSrcBase64ed + "/" + objectNameDstBase64ed + "/force/true"))
+				w.WriteHeader(612)
+			}, 1)
+			otherBucket := openOtherBucket(accessKey)
+			defer otherBucket.Close()
+			err := kodoblob.MoveBetween(ctx, otherBucket, "src-file", bucket, "dst-file", nil)
+			Expect(kodoblob.ErrorCode(err)).To(Equal(gcerrors.NotFound))
+		})
+
+		It("should succeed if the failed attempt has moved object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				switch n {
+				case 0:
+					w.WriteHeader(http.StatusServiceUnavailable)
+				case 1:
+					w.WriteHeader(612)
+				case 2:
+					Expect(r.URL.Path).To(Equal("/stat/" + base64.URLEncoding.EncodeToString([]byte(otherBucketName+":src-file"))))
+					w.WriteHeader(612)
+				case 3:
+					Expect(r.URL.Path).To(Equal("/stat/" + base64.URLEncoding.EncodeToString([]byte(otherBucketName+":dst-file"))))
+					Expect(json.NewEncoder(w).Encode(map[string]any{"hash": "hash"})).To(Succeed())
+				}
+			}, 4)
+			otherBucket := openOtherBucket(accessKey)
+			defer otherBucket.Close()
+			err := kodoblob.MoveBetween(ctx, otherBucket, "src-file", otherBucket, "dst-file", nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should reject buckets of different accounts", func(ctx context.Context) {
+			otherBucket := openOtherBucket("otheraccesskey")
+			defer otherBucket.Close()
+			err := kodoblob.CopyBetween(ctx, bucket, "src-file", otherBucket, "dst-file", nil)
+			Expect(err).To(MatchError(kodoblob.ErrDifferentAccounts))
+		})
+	})
+
+	Context("Batch", func() {
+		It("should run operations in batches", func(ctx context.Context) {
+			var requests int32
+			handler := mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				Expect(op).To(Equal("delete"))
+				Expect(bucket).To(Equal(bucketName))
+				var i int
+				_, err := fmt.Sscanf(key, "data_%05d", &i)
+				Expect(err).NotTo(HaveOccurred())
+				if i%2 == 1 {
+					return 612, map[string]any{"error": "no such file or directory"}
+				}
+				return 200, nil
+			})
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				atomic.AddInt32(&requests, 1)
+				handler(w, r, n)
+			}, 3)
+			ops := make([]kodoblob.BatchOperation, 2500)
+			for i := range ops {
+				ops[i] = kodoblob.BatchOperation{Op: kodoblob.BatchDelete, Key: fmt.Sprintf("data_%05d", i)}
+			}
+			results, err := kodoblob.Batch(ctx, bucket, ops, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(2500))
+			for i, result := range results {
+				if i%2 == 1 {
+					Expect(result.Code).To(Equal(gcerrors.NotFound))
+					Expect(result.Err).To(MatchError(ContainSubstring("no such file or directory")))
+				} else {
+					Expect(result.Code).To(Equal(gcerrors.OK))
+					Expect(result.Err).NotTo(HaveOccurred())
+				}
+			}
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+		})
+
+		It("should stat objects and retry failed operations", func(ctx context.Context) {
+			var requests int32
+			handler := mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				switch key {
+				case "stat-file":
+					Expect(op).To(Equal("stat"))
+					return 200, map[string]any{"fsize": 5, "hash": "hash", "mimeType": "text/plain", "type": 1}
+				case "copy-file":
+					Expect(op).To(Equal("copy"))
+					if atomic.LoadInt32(&requests) == 2 {
+						return 599, map[string]any{"error": "internal error"}
+					}
+					return 614, map[string]any{"error": "file exists"}
+				case "delete-file":
+					Expect(op).To(Equal("delete"))
+					return 612, map[string]any{"error": "no such file or directory"}
+				}
+				Fail("unexpected key " + key)
+				return 0, nil
+			})
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				// The copy is checked by stat as it fails on retry, the
+				// destination is not the copy of the source.
+				switch r.URL.Path {
+				case "/stat/" + base64.URLEncoding.EncodeToString([]byte(bucketName+":copy-file")):
+					Expect(json.NewEncoder(w).Encode(map[string]any{"hash": "src-hash"})).To(Succeed())
+					return
+				case "/stat/" + base64.URLEncoding.EncodeToString([]byte(bucketName+":dst-file")):
+					Expect(json.NewEncoder(w).Encode(map[string]any{"hash": "dst-hash"})).To(Succeed())
+					return
+				}
+				if atomic.AddInt32(&requests, 1) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				handler(w, r, n)
+			}, 5)
+			bucket := newBucket("uploadRetryInterval", "1ms")
+			defer bucket.Close()
+			results, err := kodoblob.Batch(ctx, bucket, []kodoblob.BatchOperation{
+				{Op: kodoblob.BatchStat, Key: "stat-file"},
+				{Op: kodoblob.BatchCopy, Key: "copy-file", DstKey: "dst-file"},
+				{Op: kodoblob.BatchDelete, Key: "delete-file"},
+				{Op: "unknown", Key: "unknown-file"},
+			}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[0].Code).To(Equal(gcerrors.OK))
+			Expect(results[0].Info.Fsize).To(Equal(int64(5)))
+			Expect(results[0].Info.Hash).To(Equal("hash"))
+			Expect(results[0].Info.MimeType).To(Equal("text/plain"))
+			Expect(results[0].Info.Type).To(Equal(1))
+			Expect(results[1].Code).To(Equal(gcerrors.AlreadyExists))
+			Expect(results[2].Code).To(Equal(gcerrors.OK))
+			Expect(results[3].Err).To(MatchError(ContainSubstring("unsupported batch operation")))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+		})
+
+		It("should delete all objects under prefix", func(ctx context.Context) {
+			keys := make([]string, 0, 2501)
+			for i := 0; i < 2500; i++ {
+				keys = append(keys, fmt.Sprintf("data/file_%05d", i))
+			}
+			keys = append(keys, "other/file")
+			rsfServer.SetHandler(mockListFiles(keys), 3)
+			var deleted sync.Map
+			rsServer.SetHandler(mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				Expect(op).To(Equal("delete"))
+				Expect(key).To(HavePrefix("data/"))
+				if key == "data/file_00000" {
+					return 612, nil
+				}
+				_, loaded := deleted.LoadOrStore(key, true)
+				Expect(loaded).To(BeFalse())
+				return 200, nil
+			}), 3)
+			count, err := kodoblob.DeletePrefix(ctx, bucket, "data/", 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(2499))
+		})
+
+		It("should stop deleting on error", func(ctx context.Context) {
+			keys := make([]string, 0, 2500)
+			for i := 0; i < 2500; i++ {
+				keys = append(keys, fmt.Sprintf("data/file_%05d", i))
+			}
+			rsfServer.SetHandler(mockListFiles(keys), 3)
+			rsServer.SetHandler(mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				return 403, map[string]any{"error": "permission denied"}
+			}), 3)
+			_, err := kodoblob.DeletePrefix(ctx, bucket, "data/", 1)
+			Expect(kodoblob.ErrorCode(err)).To(Equal(gcerrors.PermissionDenied))
+		})
+	})
+
+	Context("RenamePrefix", func() {
+		var keys []string
+		BeforeEach(func() {
+			keys = make([]string, 0, 2501)
+			for i := 0; i < 2500; i++ {
+				keys = append(keys, fmt.Sprintf("old/file_%05d", i))
+			}
+			keys = append(keys, "other/file")
+		})
+
+		It("should rename all objects under prefix", func(ctx context.Context) {
+			rsfServer.SetHandler(mockListFiles(keys), 3)
+			var moved sync.Map
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				Expect(r.ParseForm()).To(Succeed())
+				for _, op := range r.PostForm["op"] {
+					paths := strings.Split(op, "/")
+					Expect(paths[1]).To(Equal("move"))
+					Expect(paths[5]).To(Equal("false"))
+					src, err := base64.URLEncoding.DecodeString(paths[2])
+					Expect(err).NotTo(HaveOccurred())
+					dst, err := base64.URLEncoding.DecodeString(paths[3])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(strings.Replace(string(src), ":old/", ":new/dir/", 1)).To(Equal(string(dst)))
+				}
+				mockBatch(func(op, bucket, key string) (int, map[string]any) {
+					if key == "old/file_00010" {
+						return 614, map[string]any{"error": "file exists"}
+					}
+					_, loaded := moved.LoadOrStore(key, true)
+					Expect(loaded).To(BeFalse())
+					return 200, nil
+				})(w, r, n)
+			}, 3)
+
+			var (
+				lastProgress kodoblob.RenamePrefixProgress
+				conflicts    []string
+			)
+			progress, err := kodoblob.RenamePrefix(ctx, bucket, "old/", "new/dir/", &kodoblob.RenamePrefixOptions{
+				Workers: 2,
+				OnProgress: func(progress kodoblob.RenamePrefixProgress) {
+					Expect(progress.Moved).To(BeNumerically(">", lastProgress.Moved))
+					Expect(progress.Checkpoint >= lastProgress.Checkpoint).To(BeTrue())
+					lastProgress = progress
+				},
+				OnConflict: func(srcKey, dstKey string) {
+					conflicts = append(conflicts, srcKey+" "+dstKey)
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progress).To(Equal(kodoblob.RenamePrefixProgress{Moved: 2499, Conflicts: 1, Checkpoint: "old/file_02499"}))
+			Expect(lastProgress).To(Equal(progress))
+			Expect(conflicts).To(Equal([]string{"old/file_00010 new/dir/file_00010"}))
+		})
+
+		It("should count the objects moved by the failed attempts", func(ctx context.Context) {
+			rsfServer.SetHandler(mockListFiles(keys[:10]), 1)
+			var retried atomic.Bool
+			handler := mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				switch key {
+				case "old/file_00003":
+					// The failed attempt moves the object.
+					if retried.CompareAndSwap(false, true) {
+						return 599, map[string]any{"error": "internal error"}
+					}
+					return 612, map[string]any{"error": "no such file or directory"}
+				case "old/file_00005":
+					return 612, map[string]any{"error": "no such file or directory"}
+				}
+				return 200, nil
+			})
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				switch r.URL.Path {
+				case "/stat/" + base64.URLEncoding.EncodeToString([]byte(bucketName+":old/file_00003")):
+					w.WriteHeader(612)
+				case "/stat/" + base64.URLEncoding.EncodeToString([]byte(bucketName+":new/file_00003")):
+					Expect(json.NewEncoder(w).Encode(map[string]any{"hash": "hash"})).To(Succeed())
+				default:
+					handler(w, r, n)
+				}
+			}, 4)
+			bucket := newBucket("uploadRetryInterval", "1ms")
+			defer bucket.Close()
+			progress, err := kodoblob.RenamePrefix(ctx, bucket, "old/", "new/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progress).To(Equal(kodoblob.RenamePrefixProgress{Moved: 9, Checkpoint: "old/file_00009"}))
+		})
+
+		It("should resume from checkpoint", func(ctx context.Context) {
+			rsfServer.SetHandler(mockListFiles(keys), 3)
+			rsServer.SetHandler(mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				Expect(key > "old/file_01999").To(BeTrue())
+				return 200, nil
+			}), 1)
+			progress, err := kodoblob.RenamePrefix(ctx, bucket, "old/", "new/", &kodoblob.RenamePrefixOptions{
+				Checkpoint: "old/file_01999",
+				Overwrite:  true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progress).To(Equal(kodoblob.RenamePrefixProgress{Moved: 500, Checkpoint: "old/file_02499"}))
+		})
+
+		It("should keep checkpoint on error", func(ctx context.Context) {
+			rsfServer.SetHandler(mockListFiles(keys), 3)
+			rsServer.SetHandler(mockBatch(func(op, bucket, key string) (int, map[string]any) {
+				if key >= "old/file_01000" {
+					return 403, map[string]any{"error": "permission denied"}
+				}
+				return 200, nil
+			}), 2)
+			progress, err := kodoblob.RenamePrefix(ctx, bucket, "old/", "new/", &kodoblob.RenamePrefixOptions{Workers: 1})
+			Expect(kodoblob.ErrorCode(err)).To(Equal(gcerrors.PermissionDenied))
+			Expect(progress.Checkpoint).To(Equal("old/file_00999"))
+		})
+
+		It("should reject overlapping prefixes", func(ctx context.Context) {
+			_, err := kodoblob.RenamePrefix(ctx, bucket, "old/", "old/new/", nil)
+			Expect(err).To(MatchError(kodoblob.ErrOverlappingPrefixes))
+			_, err = kodoblob.RenamePrefix(ctx, bucket, "old/dir/", "old/", nil)
+			Expect(err).To(MatchError(kodoblob.ErrOverlappingPrefixes))
+		})
 	})
 
 	Context("Delte", func() {
@@ -446,5 +2050,27 @@ var _ = Describe("KodoBlob", func() {
 			err := bucket.Delete(ctx, "dst-file")
 			Expect(err).NotTo(HaveOccurred())
 		})
+
+		It("should not retry deleting absent object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, _ uint32) {
+				w.WriteHeader(612)
+			}, 1)
+			err := bucket.Delete(ctx, "dst-file")
+			Expect(gcerrors.Code(err)).To(Equal(gcerrors.NotFound))
+		})
+
+		It("should succeed if the failed attempt has deleted object", func(ctx context.Context) {
+			rsServer.SetHandler(func(w http.ResponseWriter, r *http.Request, n uint32) {
+				if n == 0 {
+					w.WriteHeader(http.StatusBadGateway)
+				} else {
+					w.WriteHeader(612)
+				}
+			}, 2)
+			bucket := newBucket("uploadRetryInterval", "1ms")
+			defer bucket.Close()
+			err := bucket.Delete(ctx, "dst-file")
+			Expect(err).NotTo(HaveOccurred())
+		})
 	})
 })
@@ -0,0 +1,95 @@
+package kodoblob
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/storage"
+)
+
+// ListFilter filters the objects listed from the kodoblob bucket. Kodo lists
+// all objects under the prefix, so the objects are filtered by the driver as
+// soon as each page is fetched, before they are converted and returned, and a
+// page may be empty while there are more pages.
+//
+// It is set per listing by ListOptions.BeforeList, whose asFunc converts its
+// argument to **ListFilter. The zero value of each field does not filter, and
+// the directories of a listing with delimiter are never filtered.
+type ListFilter struct {
+	// PutTimeAfter and PutTimeBefore limit the put time of the objects to
+	// [PutTimeAfter, PutTimeBefore).
+	PutTimeAfter  time.Time
+	PutTimeBefore time.Time
+	// MinSize and MaxSize limit the size of the objects in bytes to
+	// [MinSize, MaxSize], MaxSize limits only if it is positive.
+	MinSize int64
+	MaxSize int64
+	// MimeType limits the MIME types of the objects by the patterns separated
+	// by ";" with the syntax of path.Match, e.g. "image/*" or
+	// "image/jpeg;image/png", or excludes them if it starts with "!", e.g.
+	// "!application/json;text/plain".
+	MimeType string
+	// FileTypes limits the storage classes of the objects, 0 for standard, 1
+	// for infrequent access, 2 for archive, 3 for deep archive and 4 for
+	// archive IR.
+	FileTypes []int
+}
+
+// validate checks the MIME patterns, so that an invalid filter fails the
+// listing instead of filtering out all objects.
+func (f *ListFilter) validate() error {
+	for _, pattern := range f.mimePatterns() {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("kodoblob: invalid MIME pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (f *ListFilter) mimePatterns() []string {
+	if f.MimeType == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(f.MimeType, "!"), ";")
+}
+
+// match reports whether the listed item passes the filter.
+func (f *ListFilter) match(item *storage.ListItem) bool {
+	putTime := time.Unix(0, item.PutTime*100)
+	if !f.PutTimeAfter.IsZero() && putTime.Before(f.PutTimeAfter) {
+		return false
+	}
+	if !f.PutTimeBefore.IsZero() && !putTime.Before(f.PutTimeBefore) {
+		return false
+	}
+	if item.Fsize < f.MinSize || f.MaxSize > 0 && item.Fsize > f.MaxSize {
+		return false
+	}
+	if f.MimeType != "" {
+		matched := false
+		for _, pattern := range f.mimePatterns() {
+			if ok, _ := path.Match(pattern, item.MimeType); ok {
+				matched = true
+				break
+			}
+		}
+		if matched == strings.HasPrefix(f.MimeType, "!") {
+			return false
+		}
+	}
+	if len(f.FileTypes) > 0 {
+		matched := false
+		for _, fileType := range f.FileTypes {
+			if item.Type == fileType {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
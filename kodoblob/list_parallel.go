@@ -0,0 +1,414 @@
+package kodoblob
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+const (
+	listParallelDelimiter = "/"
+	// maxListDiscoveryDepth limits the levels of directories split from
+	// prefix, the ranges at this level are listed without delimiter.
+	maxListDiscoveryDepth = 3
+	// maxListSplitDepth limits the times a range is split by the keys after
+	// its pages, including the splits of the ranges split from it.
+	maxListSplitDepth = 4
+	// listRangeBufferSize is the number of objects buffered per range before
+	// they are delivered.
+	listRangeBufferSize = 100
+	// listTaskBufferSize is the number of ranges waiting for the workers, the
+	// ranges not fitting in are listed by the one which discovers them.
+	listTaskBufferSize = 1024
+)
+
+// utf8LeadingBytes and utf8ContinuationBytes are the ranges of the bytes
+// beginning a rune and the bytes continuing one in UTF-8.
+var (
+	utf8LeadingBytes      = [][2]int{{0x00, 0x7f}, {0xc2, 0xf4}}
+	utf8ContinuationBytes = [][2]int{{0x80, 0xbf}}
+)
+
+// listRange is a range of keys listed by ListParallel, which is all objects
+// under prefix, either a directory or the keys starting with a byte after a
+// page of its parent range.
+type listRange struct {
+	prefix string
+	depth  int
+	// splits is the times the range can be split if it has more than a page
+	// of entries.
+	splits int
+	// scheduled reports whether the range is sent to the workers, it is only
+	// accessed by the lister which discovers the range.
+	scheduled bool
+	claimed   atomic.Bool
+	// items and err are the listed items and the error of the range listed
+	// by a worker for ListParallelInOrder, err is set before items is closed.
+	items chan listItem
+	err   error
+}
+
+// claim reports whether the caller is the first to list the range.
+func (r *listRange) claim() bool {
+	return r.claimed.CompareAndSwap(false, true)
+}
+
+// listItem is an object or a child range of a range, in key order.
+type listItem struct {
+	object *blob.ListObject
+	child  *listRange
+}
+
+// ListParallel lists all objects under prefix of the kodoblob bucket and calls
+// fn with each of them. The key space is split into ranges while listing: the
+// directories separated by "/" become ranges once they are listed, and a range
+// with more than a page of entries is split after each page by the first rune
+// in which the keys of the page differ: the listing continues with the keys
+// sharing the rune with the last key, and the keys after them become ranges by
+// the bytes which may follow in UTF-8, each costing a list request. The ranges
+// split from a range are split again, at most 4 times in all. If the bucket
+// rejects the prefixes which are not valid UTF-8, the ranges are not split by
+// bytes. The ranges are listed concurrently by at most shards workers, and the
+// objects are delivered as soon as they are listed.
+//
+// fn is never called concurrently, but the objects are delivered in no
+// particular order, see ListParallelInOrder. The first error returned by fn or
+// listing stops the listing and is returned.
+func ListParallel(ctx context.Context, bucket *blob.Bucket, prefix string, shards int, fn func(*blob.ListObject) error) error {
+	return listParallel(ctx, bucket, prefix, shards, false, fn)
+}
+
+// ListParallelInOrder is like ListParallel, but delivers the objects in key
+// order. The ranges are still listed concurrently, while the ones after the
+// range being delivered may wait for their buffers to be drained, and the
+// ranges not listed by the workers yet are listed while being delivered.
+func ListParallelInOrder(ctx context.Context, bucket *blob.Bucket, prefix string, shards int, fn func(*blob.ListObject) error) error {
+	return listParallel(ctx, bucket, prefix, shards, true, fn)
+}
+
+// parallelLister lists the ranges of ListParallel, the workers take the ranges
+// from tasks, and the unscheduled ones are listed by their discoverers.
+type parallelLister struct {
+	ctx     context.Context
+	bucket  *blob.Bucket
+	inOrder bool
+	fn      func(*blob.ListObject) error
+
+	// pending counts the ranges in tasks or being listed by the workers.
+	pending sync.WaitGroup
+	tasks   chan *listRange
+	merged  chan *blob.ListObject
+
+	errLock  sync.Mutex
+	firstErr error
+	cancel   context.CancelFunc
+
+	// probeOnce probes whether the bucket accepts the prefixes which are not
+	// valid UTF-8, once a range is split by such prefixes.
+	probeOnce       sync.Once
+	invalidPrefixes bool
+	probeErr        error
+}
+
+func listParallel(ctx context.Context, bucket *blob.Bucket, prefix string, shards int, inOrder bool, fn func(*blob.ListObject) error) error {
+	if _, err := kodoBucket(bucket); err != nil {
+		return err
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l := &parallelLister{
+		ctx:     ctx,
+		bucket:  bucket,
+		inOrder: inOrder,
+		fn:      fn,
+		tasks:   make(chan *listRange, listTaskBufferSize),
+		merged:  make(chan *blob.ListObject, listRangeBufferSize),
+		cancel:  cancel,
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < shards; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			l.work()
+		}()
+	}
+
+	var err error
+	root := l.newRange(prefix, 0, maxListSplitDepth)
+	if inOrder {
+		err = l.deliver(root)
+	} else {
+		// No range is scheduled once all scheduled ranges are listed.
+		l.schedule(root)
+		go func() {
+			l.pending.Wait()
+			close(l.merged)
+		}()
+		err = l.deliverMerged()
+	}
+	if err != nil {
+		l.setError(err)
+	}
+	cancel()
+	workers.Wait()
+	// The ranges left by the stopped workers are never listed.
+	for len(l.tasks) > 0 {
+		<-l.tasks
+		l.pending.Done()
+	}
+	l.errLock.Lock()
+	defer l.errLock.Unlock()
+	return l.firstErr
+}
+
+func (l *parallelLister) setError(err error) {
+	l.errLock.Lock()
+	defer l.errLock.Unlock()
+	if l.firstErr == nil {
+		l.firstErr = err
+		l.cancel()
+	}
+}
+
+func (l *parallelLister) newRange(prefix string, depth, splits int) *listRange {
+	r := &listRange{prefix: prefix, depth: depth, splits: splits}
+	if l.inOrder {
+		r.items = make(chan listItem, listRangeBufferSize)
+	}
+	return r
+}
+
+// schedule sends r to the workers unless tasks is full.
+func (l *parallelLister) schedule(r *listRange) {
+	l.pending.Add(1)
+	select {
+	case l.tasks <- r:
+		r.scheduled = true
+	default:
+		l.pending.Done()
+	}
+}
+
+// work lists the scheduled ranges until ctx is done, the objects are sent to
+// merged, or to the items of the ranges for ListParallelInOrder.
+func (l *parallelLister) work() {
+	for {
+		select {
+		case r := <-l.tasks:
+			if r.claim() {
+				if l.inOrder {
+					r.err = l.list(r, func(item listItem) error {
+						select {
+						case r.items <- item:
+							return nil
+						case <-l.ctx.Done():
+							return l.ctx.Err()
+						}
+					})
+					close(r.items)
+				} else if err := l.list(r, l.emitMerged); err != nil {
+					l.setError(err)
+				}
+			}
+			l.pending.Done()
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+// emitMerged sends the listed object to merged, and lists the child range by
+// itself if it is not scheduled.
+func (l *parallelLister) emitMerged(item listItem) error {
+	if item.child != nil {
+		if !item.child.scheduled {
+			return l.list(item.child, l.emitMerged)
+		}
+		return nil
+	}
+	select {
+	case l.merged <- item.object:
+		return nil
+	case <-l.ctx.Done():
+		return l.ctx.Err()
+	}
+}
+
+func (l *parallelLister) deliverMerged() error {
+	for {
+		select {
+		case object, ok := <-l.merged:
+			if !ok {
+				return nil
+			}
+			if err := l.fn(object); err != nil {
+				return err
+			}
+		case <-l.ctx.Done():
+			return l.ctx.Err()
+		}
+	}
+}
+
+// deliver calls fn with the objects of r in key order, r is listed here if no
+// worker has taken it.
+func (l *parallelLister) deliver(r *listRange) error {
+	if r.claim() {
+		return l.list(r, l.deliverItem)
+	}
+	for {
+		select {
+		case item, ok := <-r.items:
+			if !ok {
+				return r.err
+			}
+			if err := l.deliverItem(item); err != nil {
+				return err
+			}
+		case <-l.ctx.Done():
+			return l.ctx.Err()
+		}
+	}
+}
+
+func (l *parallelLister) deliverItem(item listItem) error {
+	if item.child != nil {
+		return l.deliver(item.child)
+	}
+	return l.fn(item.object)
+}
+
+// list lists the entries of r page by page and emits them in key order. The
+// directories become child ranges, and if r has more pages, the listing may be
+// narrowed to the keys sharing a prefix with the last entry of the page by
+// split, the child ranges of the keys left out are emitted at last.
+func (l *parallelLister) list(r *listRange, emit func(listItem) error) error {
+	opts := &blob.ListOptions{Prefix: r.prefix}
+	if r.depth < maxListDiscoveryDepth {
+		opts.Delimiter = listParallelDelimiter
+	}
+	var (
+		token  = blob.FirstPageToken
+		base   = r.prefix
+		splits = r.splits
+		tail   []*listRange
+	)
+	for len(token) > 0 {
+		objects, next, err := l.bucket.ListPage(l.ctx, token, defaultPageSize, opts)
+		if err != nil {
+			return err
+		}
+		for i, object := range objects {
+			if !strings.HasPrefix(object.Key, base) {
+				objects, next = objects[:i], nil
+				break
+			}
+			item := listItem{object: object}
+			if object.IsDir {
+				item = listItem{child: l.newRange(object.Key, r.depth+1, maxListSplitDepth)}
+				l.schedule(item.child)
+			}
+			if err := emit(item); err != nil {
+				return err
+			}
+		}
+		if len(next) > 0 && splits > 0 && len(objects) > 0 {
+			until, children, err := l.split(r, base, objects[0].Key, objects[len(objects)-1].Key, splits-1)
+			if err != nil {
+				return err
+			}
+			if until != base {
+				base, splits, tail = until, splits-1, append(children, tail...)
+			}
+		}
+		token = next
+	}
+	for _, child := range tail {
+		if err := emit(listItem{child: child}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split splits the keys of r after last under base. It returns the prefix of
+// last ending with the first rune in which first and last differ, and the
+// child ranges of the other keys after last in key order, by the prefixes of
+// last followed by a larger byte which may be at the position in UTF-8. The
+// child ranges are scheduled and can be split the given times.
+//
+// base is returned if the keys cannot be split, that is first is last, or the
+// children are not valid UTF-8 and the bucket rejects such prefixes.
+func (l *parallelLister) split(r *listRange, base, first, last string, splits int) (string, []*listRange, error) {
+	n := len(base)
+	for n < len(first) && n < len(last) && first[n] == last[n] {
+		n++
+	}
+	if n == len(last) {
+		return base, nil, nil
+	}
+	for n > len(base) && !utf8.RuneStart(last[n]) {
+		n--
+	}
+	_, size := utf8.DecodeRuneInString(last[n:])
+	until := last[:n+size]
+
+	var (
+		prefixes []string
+		valid    = true
+	)
+	for i := len(until) - 1; i >= len(base); i-- {
+		spans := utf8ContinuationBytes
+		if utf8.RuneStart(last[i]) {
+			spans = utf8LeadingBytes
+		}
+		for _, span := range spans {
+			c := span[0]
+			if c <= int(last[i]) {
+				c = int(last[i]) + 1
+			}
+			for ; c <= span[1]; c++ {
+				prefix := last[:i] + string([]byte{byte(c)})
+				valid = valid && utf8.ValidString(prefix)
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	if !valid {
+		if ok, err := l.acceptsInvalidPrefixes(base); err != nil || !ok {
+			return base, nil, err
+		}
+	}
+	children := make([]*listRange, len(prefixes))
+	for i, prefix := range prefixes {
+		children[i] = l.newRange(prefix, r.depth, splits)
+		l.schedule(children[i])
+	}
+	return until, children, nil
+}
+
+// acceptsInvalidPrefixes reports whether the bucket lists by the prefixes which
+// are not valid UTF-8, which is probed once by listing prefix followed by a
+// byte never in UTF-8. The bucket rejecting it lists with the valid prefixes
+// only.
+func (l *parallelLister) acceptsInvalidPrefixes(prefix string) (bool, error) {
+	l.probeOnce.Do(func() {
+		_, _, err := l.bucket.ListPage(l.ctx, blob.FirstPageToken, 1, &blob.ListOptions{Prefix: prefix + "\xff"})
+		switch {
+		case err == nil:
+			l.invalidPrefixes = true
+		case gcerrors.Code(err) != gcerrors.InvalidArgument:
+			l.probeErr = err
+		}
+	})
+	return l.invalidPrefixes, l.probeErr
+}
@@ -0,0 +1,136 @@
+package kodoblob
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/storage"
+)
+
+const (
+	// listPrefetchTimeout limits both the request of a prefetched page and
+	// how long it is kept if the listing is abandoned.
+	listPrefetchTimeout = time.Minute
+	// maxPrefetchedPages is the max number of listings prefetched at the same
+	// time, the oldest one is dropped once exceeded.
+	maxPrefetchedPages = 64
+)
+
+// listPage identifies a page of a listing, whose marker is the page token.
+type listPage struct {
+	prefix    string
+	delimiter string
+	marker    string
+	pageSize  int
+}
+
+type listPageResult struct {
+	ret     *storage.ListFilesRet
+	hasNext bool
+	err     error
+}
+
+type prefetchedPage struct {
+	done      chan struct{}
+	cancel    context.CancelFunc
+	createdAt time.Time
+	result    listPageResult
+}
+
+// listPrefetcher fetches the next page of a listing in background once a page
+// is returned, so that iterating over the bucket does not stall on every page
+// boundary. The page token is still the marker of Kodo, so a listing can be
+// resumed from it without the prefetched page.
+type listPrefetcher struct {
+	fetch func(ctx context.Context, page listPage) listPageResult
+
+	lock  sync.Mutex
+	pages map[listPage]*prefetchedPage
+}
+
+func newListPrefetcher(fetch func(ctx context.Context, page listPage) listPageResult) *listPrefetcher {
+	return &listPrefetcher{fetch: fetch, pages: make(map[listPage]*prefetchedPage)}
+}
+
+// get returns the page, which is prefetched if the previous page is returned
+// by get, and starts prefetching the next page.
+func (p *listPrefetcher) get(ctx context.Context, page listPage) listPageResult {
+	var result listPageResult
+	if prefetched := p.take(page); prefetched != nil {
+		select {
+		case <-prefetched.done:
+			result = prefetched.result
+		case <-ctx.Done():
+			prefetched.cancel()
+			return listPageResult{err: ctx.Err()}
+		}
+		prefetched.cancel()
+	}
+	if result.ret == nil || result.err != nil {
+		// The prefetched page may fail for its own timeout, fetch it again.
+		result = p.fetch(ctx, page)
+	}
+	if result.err == nil && result.hasNext {
+		next := page
+		next.marker = result.ret.Marker
+		p.prefetch(next)
+	}
+	return result
+}
+
+func (p *listPrefetcher) take(page listPage) *prefetchedPage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prefetched := p.pages[page]
+	delete(p.pages, page)
+	return prefetched
+}
+
+func (p *listPrefetcher) prefetch(page listPage) {
+	ctx, cancel := context.WithTimeout(context.Background(), listPrefetchTimeout)
+	prefetched := &prefetchedPage{done: make(chan struct{}), cancel: cancel, createdAt: time.Now()}
+
+	p.lock.Lock()
+	p.evict()
+	if old, ok := p.pages[page]; ok {
+		old.cancel()
+	}
+	p.pages[page] = prefetched
+	p.lock.Unlock()
+
+	go func() {
+		defer close(prefetched.done)
+		prefetched.result = p.fetch(ctx, page)
+	}()
+}
+
+// evict drops the expired pages and the oldest one if there are too many.
+func (p *listPrefetcher) evict() {
+	var (
+		oldestPage listPage
+		oldest     *prefetchedPage
+	)
+	for page, prefetched := range p.pages {
+		if time.Since(prefetched.createdAt) > listPrefetchTimeout {
+			prefetched.cancel()
+			delete(p.pages, page)
+		} else if oldest == nil || prefetched.createdAt.Before(oldest.createdAt) {
+			oldestPage, oldest = page, prefetched
+		}
+	}
+	if len(p.pages) >= maxPrefetchedPages {
+		oldest.cancel()
+		delete(p.pages, oldestPage)
+	}
+}
+
+// close cancels all pages being prefetched.
+func (p *listPrefetcher) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for page, prefetched := range p.pages {
+		prefetched.cancel()
+		delete(p.pages, page)
+	}
+}
@@ -0,0 +1,35 @@
+package kodoblob
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/qiniu/go-sdk/v7/auth"
+)
+
+// manage posts the management request of uri, e.g. storage.URIDelete, to the
+// rs host of the bucket with ctx, so that cancelling ctx aborts the request,
+// and decodes the response into ret if it is not nil.
+// The retryable errors are retried by the retry policy of the bucket, and
+// retried reports whether the returned error is from a retry, after which the
+// previous failed attempt may have been applied.
+func (b *bucket) manage(ctx context.Context, uri string, ret interface{}) (retried bool, err error) {
+	rsHost, err := b.bucketManager.RsReqHost(b.name)
+	if err != nil {
+		return false, err
+	}
+	policy := b.retryPolicy
+	for i := 0; i < policy.tryTimes; i++ {
+		if i > 0 {
+			if err := policy.wait(ctx, i); err != nil {
+				return retried, err
+			}
+			retried = true
+		}
+		err = b.bucketManager.Client.CredentialedCall(ctx, b.bucketManager.Mac, auth.TokenQiniu, ret, http.MethodPost, rsHost+uri, nil)
+		if err == nil || !isRetryableError(err) || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
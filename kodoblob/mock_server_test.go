@@ -1,13 +1,28 @@
 package kodoblob_test
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+
+	"github.com/qiniu/go-sdk/v7/storage"
 )
 
 type HandlerFunc func(http.ResponseWriter, *http.Request, uint32)
@@ -47,7 +62,7 @@ func (ms *mockServer) createMockHandler() http.Handler {
 		} else if ms.mux != nil && n < ms.max {
 			ms.mux.ServeHTTP(w, r)
 		} else {
-			Fail("should not reach here")
+			Fail("should not reach here: " + r.Method + " " + r.URL.String())
 		}
 	})
 }
@@ -76,3 +91,399 @@ func (ms *mockServer) WithMux(f func(*http.ServeMux), max uint32) {
 	ms.max = max
 	f(ms.mux)
 }
+
+type mockUploadedPart struct {
+	Etag       string `json:"etag"`
+	PartNumber int64  `json:"partNumber"`
+}
+
+type mockCompletePartsBody struct {
+	Parts      []mockUploadedPart `json:"parts"`
+	MimeType   string             `json:"mimeType,omitempty"`
+	Metadata   map[string]string  `json:"metadata,omitempty"`
+	CustomVars map[string]string  `json:"customVars,omitempty"`
+}
+
+// mockMultipartUpload serves the multipart upload v2 and form upload APIs for
+// a single key.
+type mockMultipartUpload struct {
+	bucketName string
+	key        string
+	uploadId   string
+	partDelay  time.Duration
+	// partStatus returns the status code to fail the part upload with, or 0.
+	partStatus func(partNumber int64) int
+	// hash is returned instead of the etag of the object if it is not empty.
+	hash string
+
+	lock         sync.Mutex
+	upToken      string
+	initiates    int
+	formUploads  int
+	partUploads  int
+	uploading    int
+	maxUploading int
+	parts        map[int64][]byte
+	completed    bool
+	aborted      bool
+	completeBody mockCompletePartsBody
+	data         []byte
+	etag         string
+	savedKey     string
+}
+
+func newMockMultipartUpload(bucketName, key string) *mockMultipartUpload {
+	return &mockMultipartUpload{
+		bucketName: bucketName,
+		key:        key,
+		uploadId:   "fakeuploadid",
+		parts:      make(map[int64][]byte),
+	}
+}
+
+func (u *mockMultipartUpload) Register(mux *http.ServeMux) {
+	encodedKey := "~"
+	if u.key != "" {
+		encodedKey = base64.URLEncoding.EncodeToString([]byte(u.key))
+	}
+	pathPrefix := "/buckets/" + u.bucketName + "/objects/" + encodedKey + "/uploads"
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, pathPrefix), "/")
+		w.Header().Set("Content-Type", "application/json")
+		if path == "" {
+			Expect(r.Method).To(Equal(http.MethodPost))
+			u.lock.Lock()
+			u.initiates += 1
+			u.upToken = strings.TrimPrefix(r.Header.Get("Authorization"), "UpToken ")
+			u.lock.Unlock()
+			err := json.NewEncoder(w).Encode(map[string]any{"uploadId": u.uploadId, "expireAt": time.Now().Add(7 * 24 * time.Hour).Unix()})
+			Expect(err).NotTo(HaveOccurred())
+			return
+		}
+		Expect(path).To(HavePrefix(u.uploadId))
+		path = strings.TrimPrefix(strings.TrimPrefix(path, u.uploadId), "/")
+		if path == "" && r.Method == http.MethodDelete {
+			Expect(r.Header.Get("Authorization")).To(HavePrefix("UpToken "))
+			u.lock.Lock()
+			u.aborted = true
+			u.lock.Unlock()
+			_, err := w.Write([]byte("{}"))
+			Expect(err).NotTo(HaveOccurred())
+			return
+		}
+		if path == "" {
+			Expect(r.Method).To(Equal(http.MethodPost))
+			var body mockCompletePartsBody
+			err := json.NewDecoder(r.Body).Decode(&body)
+			Expect(err).NotTo(HaveOccurred())
+			parts := make([][]byte, 0, len(body.Parts))
+			u.lock.Lock()
+			for _, part := range body.Parts {
+				Expect(part.Etag).To(Equal(fmt.Sprintf("fakeetag_%d", part.PartNumber)))
+				parts = append(parts, u.parts[part.PartNumber])
+			}
+			u.lock.Unlock()
+			u.commit(w, strings.TrimPrefix(r.Header.Get("Authorization"), "UpToken "), body, parts)
+			return
+		}
+		Expect(r.Method).To(Equal(http.MethodPut))
+		u.lock.Lock()
+		u.uploading += 1
+		if u.uploading > u.maxUploading {
+			u.maxUploading = u.uploading
+		}
+		u.lock.Unlock()
+		defer func() {
+			u.lock.Lock()
+			u.uploading -= 1
+			u.lock.Unlock()
+		}()
+		time.Sleep(u.partDelay)
+		partNumber, err := strconv.ParseInt(path, 10, 64)
+		Expect(err).NotTo(HaveOccurred())
+		u.lock.Lock()
+		u.partUploads += 1
+		u.lock.Unlock()
+		if u.partStatus != nil {
+			if status := u.partStatus(partNumber); status != 0 {
+				w.WriteHeader(status)
+				err = json.NewEncoder(w).Encode(map[string]any{"error": "mock part upload error"})
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+		}
+		data, err := io.ReadAll(r.Body)
+		Expect(err).NotTo(HaveOccurred())
+		md5Value := md5.Sum(data)
+		Expect(r.Header.Get("Content-MD5")).To(Equal(hex.EncodeToString(md5Value[:])))
+		u.lock.Lock()
+		u.parts[partNumber] = data
+		u.lock.Unlock()
+		err = json.NewEncoder(w).Encode(map[string]any{"etag": "fakeetag_" + path, "md5": hex.EncodeToString(md5Value[:])})
+		Expect(err).NotTo(HaveOccurred())
+	}
+	mux.HandleFunc(pathPrefix, handler)
+	mux.HandleFunc(pathPrefix+"/", handler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		Expect(r.Method).To(Equal(http.MethodPost))
+		Expect(r.URL.Path).To(Equal("/"))
+		err := r.ParseMultipartForm(32 << 20)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.FormValue("key")).To(Equal(u.key))
+		file, fileHeader, err := r.FormFile("file")
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.FormValue("crc32")).To(Equal(fmt.Sprintf("%010d", crc32.ChecksumIEEE(data))))
+		body := mockCompletePartsBody{MimeType: fileHeader.Header.Get("Content-Type"), Metadata: make(map[string]string)}
+		for name, values := range r.MultipartForm.Value {
+			if strings.HasPrefix(name, "x-qn-meta-") {
+				body.Metadata[name] = values[0]
+			}
+		}
+		u.lock.Lock()
+		u.formUploads += 1
+		u.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		u.commit(w, r.FormValue("token"), body, [][]byte{data})
+	})
+}
+
+// commit creates the object unless it exists and the upload token is insert
+// only or scoped to the bucket only, in which case an error response is
+// written. The response is relayed
+// from the callback URL or rendered from the return body of the upload token
+// if any.
+func (u *mockMultipartUpload) commit(w http.ResponseWriter, upToken string, body mockCompletePartsBody, parts [][]byte) {
+	data := bytes.Join(parts, nil)
+	putPolicy := decodeMockPutPolicy(upToken)
+	insertOnly := putPolicy.InsertOnly != 0 || !strings.Contains(putPolicy.Scope, ":")
+	hash := u.hash
+	if hash == "" {
+		hash = mockEtag(parts)
+	}
+	key := u.key
+	if putPolicy.SaveKey != "" && (key == "" || putPolicy.ForceSaveKey) {
+		Expect(putPolicy.Scope).To(Equal(u.bucketName))
+		key = strings.NewReplacer("$(etag)", hash).Replace(putPolicy.SaveKey)
+	} else if bucketName, scopeKey, ok := strings.Cut(putPolicy.Scope, ":"); ok {
+		Expect(bucketName).To(Equal(u.bucketName))
+		Expect(scopeKey).To(Equal(key))
+	}
+	u.lock.Lock()
+	existed := u.completed
+	u.upToken = upToken
+	if !existed || !insertOnly {
+		u.completed = true
+		u.completeBody = body
+		u.data = data
+		u.etag = hash
+		u.savedKey = key
+	}
+	u.lock.Unlock()
+	if existed && insertOnly {
+		w.WriteHeader(614)
+		err := json.NewEncoder(w).Encode(map[string]any{"error": "file exists"})
+		Expect(err).NotTo(HaveOccurred())
+		return
+	}
+	replacer := strings.NewReplacer("$(key)", key, "$(etag)", hash, "$(fsize)", strconv.Itoa(len(data)))
+	if putPolicy.CallbackURL != "" {
+		resp, err := http.Post(putPolicy.CallbackURL, putPolicy.CallbackBodyType, strings.NewReader(replacer.Replace(putPolicy.CallbackBody)))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		_, err = io.Copy(w, resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+	} else if putPolicy.ReturnBody != "" {
+		_, err := io.WriteString(w, replacer.Replace(putPolicy.ReturnBody))
+		Expect(err).NotTo(HaveOccurred())
+	} else {
+		err := json.NewEncoder(w).Encode(map[string]any{"key": key, "hash": hash})
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+// mockEtag returns the etag of the object uploaded in parts, which is the etag
+// v1 if it is uploaded in a single part or in parts of 4MB, otherwise the etag
+// v2 combining the etag v1 of the parts.
+func mockEtag(parts [][]byte) string {
+	const blockSize = 4 * 1024 * 1024
+	etagV1 := func(data []byte) []byte {
+		if len(data) <= blockSize {
+			sum := sha1.Sum(data)
+			return append([]byte{0x16}, sum[:]...)
+		}
+		var sums []byte
+		for ; len(data) > blockSize; data = data[blockSize:] {
+			sum := sha1.Sum(data[:blockSize])
+			sums = append(sums, sum[:]...)
+		}
+		sum := sha1.Sum(data)
+		sums = append(sums, sum[:]...)
+		sum = sha1.Sum(sums)
+		return append([]byte{0x96}, sum[:]...)
+	}
+	if len(parts) == 1 {
+		return base64.URLEncoding.EncodeToString(etagV1(parts[0]))
+	}
+	prefix := byte(0x96)
+	var sums []byte
+	for i, part := range parts {
+		if i < len(parts)-1 && len(part) != blockSize {
+			prefix = 0x9e
+		}
+		sums = append(sums, etagV1(part)[1:]...)
+	}
+	sum := sha1.Sum(sums)
+	return base64.URLEncoding.EncodeToString(append([]byte{prefix}, sum[:]...))
+}
+
+func decodeMockPutPolicy(upToken string) (putPolicy storage.PutPolicy) {
+	parts := strings.Split(upToken, ":")
+	Expect(parts).To(HaveLen(3))
+	policyJson, err := base64.URLEncoding.DecodeString(parts[2])
+	Expect(err).NotTo(HaveOccurred())
+	err = json.Unmarshal(policyJson, &putPolicy)
+	Expect(err).NotTo(HaveOccurred())
+	return
+}
+
+func (u *mockMultipartUpload) Completed() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.completed
+}
+
+// FormUploads returns the number of form upload requests.
+func (u *mockMultipartUpload) FormUploads() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.formUploads
+}
+
+// Requests returns the number of init and part upload requests.
+func (u *mockMultipartUpload) Requests() (initiates, partUploads int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.initiates, u.partUploads
+}
+
+// UpToken returns the upload token used to initiate the upload.
+func (u *mockMultipartUpload) UpToken() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.upToken
+}
+
+// MaxUploadingParts returns the maximum number of parts uploaded concurrently.
+func (u *mockMultipartUpload) MaxUploadingParts() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.maxUploading
+}
+
+func (u *mockMultipartUpload) Aborted() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.aborted
+}
+
+func (u *mockMultipartUpload) CompleteBody() mockCompletePartsBody {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.completeBody
+}
+
+// SavedKey returns the key of the uploaded object, which may be generated from
+// the save key of the upload token.
+func (u *mockMultipartUpload) SavedKey() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.savedKey
+}
+
+// Hash returns the hash of the uploaded object in the response.
+func (u *mockMultipartUpload) Hash() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.etag
+}
+
+// Data returns the content of the completed object.
+func (u *mockMultipartUpload) Data() []byte {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.data
+}
+
+// mockListFiles returns a handler of the list API listing the sorted keys. The
+// marker is the last key or common prefix of the previous page.
+func mockListFiles(keys []string) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, n uint32) {
+		query := r.URL.Query()
+		prefix, delimiter, marker := query.Get("prefix"), query.Get("delimiter"), query.Get("marker")
+		limit, err := strconv.Atoi(query.Get("limit"))
+		Expect(err).NotTo(HaveOccurred())
+
+		var (
+			items          = make([]map[string]any, 0, limit)
+			commonPrefixes = make([]string, 0)
+			last           string
+			nextMarker     string
+		)
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) || key <= marker || delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(key, marker) {
+				continue
+			}
+			commonPrefix := ""
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					commonPrefix = key[:len(prefix)+i+len(delimiter)]
+					if commonPrefix == last {
+						continue
+					}
+				}
+			}
+			if len(items)+len(commonPrefixes) == limit {
+				nextMarker = last
+				break
+			}
+			if commonPrefix != "" {
+				commonPrefixes = append(commonPrefixes, commonPrefix)
+				last = commonPrefix
+			} else {
+				items = append(items, map[string]any{"key": key, "fsize": len(key)})
+				last = key
+			}
+		}
+		responseBodyJson := map[string]any{"items": items, "commonPrefixes": commonPrefixes}
+		if nextMarker != "" {
+			responseBodyJson["marker"] = nextMarker
+		}
+		Expect(json.NewEncoder(w).Encode(responseBodyJson)).To(Succeed())
+	}
+}
+
+// mockBatch returns a handler of the batch API, which decodes the entries of
+// the operations and responds with the results of f.
+func mockBatch(f func(op, bucket, key string) (int, map[string]any)) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, n uint32) {
+		Expect(r.Method).To(Equal(http.MethodPost))
+		Expect(r.URL.Path).To(Equal("/batch"))
+		Expect(r.ParseForm()).To(Succeed())
+		ops := r.PostForm["op"]
+		Expect(len(ops)).To(BeNumerically("<=", 1000))
+		rets := make([]map[string]any, 0, len(ops))
+		for _, op := range ops {
+			paths := strings.Split(op, "/")
+			entry, err := base64.URLEncoding.DecodeString(paths[2])
+			Expect(err).NotTo(HaveOccurred())
+			bucket, key, _ := strings.Cut(string(entry), ":")
+			code, data := f(paths[1], bucket, key)
+			rets = append(rets, map[string]any{"code": code, "data": data})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(298)
+		Expect(json.NewEncoder(w).Encode(rets)).To(Succeed())
+	}
+}
@@ -0,0 +1,417 @@
+package kodoblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/client"
+	"github.com/qiniu/go-sdk/v7/storage"
+)
+
+const (
+	defaultPartSize       = 4 * 1024 * 1024
+	minPartSize           = 1024 * 1024
+	maxPartSize           = 1024 * 1024 * 1024
+	defaultMaxConcurrency = 4
+	// defaultFormUploadThreshold is the max size of objects uploaded in a
+	// single form upload request, objects larger than a part are always
+	// uploaded in parts.
+	defaultFormUploadThreshold = 4 * 1024 * 1024
+	initialBufferSize          = 64 * 1024
+	abortTimeout               = 30 * time.Second
+)
+
+// multipartUpload uploads an object part by part with the multipart upload
+// v2 APIs, see https://developer.qiniu.com/kodo/6364/multipartupload-interface
+// At most concurrency parts are uploaded at the same time and uploadPart blocks
+// until a slot is available, so a writer holds no more than concurrency+1 part
+// buffers including the one being filled.
+//
+// The first error fails the whole upload, the parts being uploaded are
+// cancelled and the error is returned from all later calls.
+type multipartUpload struct {
+	b        *bucket
+	ctx      context.Context
+	cancel   context.CancelFunc
+	key      string
+	hasKey   bool
+	upToken  string
+	uploader *storage.ResumeUploaderV2
+	extra    storage.RputV2Extra
+	partSize int
+
+	upHosts  []string
+	uploadId string
+	slots    chan struct{}
+	buffers  chan []byte
+	wg       sync.WaitGroup
+
+	lock  sync.Mutex
+	parts []storage.UploadPartInfo
+	err   error
+
+	onProgress   func(Progress)
+	progressLock sync.Mutex
+	progress     Progress
+}
+
+func newMultipartUpload(ctx context.Context, b *bucket, key, upToken string, extra storage.RputV2Extra, partSize, concurrency int) *multipartUpload {
+	ctx, cancel := context.WithCancel(ctx)
+	return &multipartUpload{
+		b:        b,
+		ctx:      ctx,
+		cancel:   cancel,
+		key:      key,
+		hasKey:   key != "",
+		upToken:  upToken,
+		uploader: storage.NewResumeUploaderV2Ex(b.config, nil),
+		extra:    extra,
+		partSize: partSize,
+		slots:    make(chan struct{}, concurrency),
+		buffers:  make(chan []byte, concurrency),
+		progress: Progress{TotalBytes: -1},
+	}
+}
+
+// buffer returns an empty buffer with the capacity of a part, reusing the
+// buffers of uploaded parts.
+func (u *multipartUpload) buffer() []byte {
+	select {
+	case buf := <-u.buffers:
+		return buf[:0]
+	default:
+		return make([]byte, 0, u.partSize)
+	}
+}
+
+func (u *multipartUpload) init() error {
+	if u.uploadId != "" {
+		return nil
+	}
+	upHosts, err := u.b.upHosts(u.ctx)
+	if err != nil {
+		return err
+	}
+	u.upHosts = upHosts
+	var ret storage.InitPartsRet
+	if err = u.withRetries(func(upHost string) error {
+		return u.uploader.InitParts(u.ctx, u.upToken, upHost, u.b.name, u.key, u.hasKey, &ret)
+	}); err != nil {
+		return err
+	}
+	u.uploadId = ret.UploadID
+	return nil
+}
+
+// uploadPart uploads data as the part numbered partNumber in background, the
+// ownership of data is taken until the part is uploaded.
+func (u *multipartUpload) uploadPart(partNumber int64, data []byte) error {
+	if err := u.error(); err != nil {
+		return err
+	}
+	if err := u.init(); err != nil {
+		u.setError(err)
+		return err
+	}
+	select {
+	case u.slots <- struct{}{}:
+	case <-u.ctx.Done():
+		u.setError(u.ctx.Err())
+		return u.error()
+	}
+	u.wg.Add(1)
+	go func() {
+		defer func() {
+			<-u.slots
+			u.wg.Done()
+		}()
+		md5Value := md5.Sum(data)
+		var (
+			ret        storage.UploadPartsRet
+			lastUpHost string
+		)
+		err := u.withRetries(func(upHost string) error {
+			lastUpHost = upHost
+			return u.uploader.UploadParts(u.ctx, u.upToken, upHost, u.b.name, u.key, u.hasKey, u.uploadId,
+				partNumber, hex.EncodeToString(md5Value[:]), &ret, bytes.NewReader(data), len(data))
+		})
+		if err != nil {
+			u.setError(err)
+			return
+		}
+		u.lock.Lock()
+		u.parts = append(u.parts, storage.UploadPartInfo{Etag: ret.Etag, PartNumber: partNumber})
+		u.lock.Unlock()
+		u.addProgress(int64(len(data)), 1, lastUpHost)
+		select {
+		case u.buffers <- data:
+		default:
+		}
+	}()
+	return nil
+}
+
+// wait waits for all parts being uploaded and returns the first error.
+func (u *multipartUpload) wait() error {
+	u.wg.Wait()
+	return u.error()
+}
+
+// complete waits for all parts being uploaded and completes the upload, the
+// upload is never completed once ctx is done.
+func (u *multipartUpload) complete(ret interface{}) error {
+	defer u.cancel()
+	if err := u.init(); err != nil {
+		return err
+	}
+	if err := u.wait(); err != nil {
+		return err
+	}
+	if err := u.ctx.Err(); err != nil {
+		return err
+	}
+	sort.Slice(u.parts, func(i, j int) bool {
+		return u.parts[i].PartNumber < u.parts[j].PartNumber
+	})
+	u.extra.Progresses = u.parts
+	return u.withRetries(func(upHost string) error {
+		return u.uploader.CompleteParts(u.ctx, u.upToken, upHost, ret, u.b.name, u.key, u.hasKey, u.uploadId, &u.extra)
+	})
+}
+
+// uploadReaderAt uploads r of the known size part by part like the writer,
+// reading each part while the previous ones are being uploaded, and aborts the
+// upload on failure.
+func (u *multipartUpload) uploadReaderAt(r io.ReaderAt, size int64, ret interface{}) error {
+	u.setTotalBytes(size)
+	partSize := int64(u.partSize)
+	for partNumber, offset := int64(1), int64(0); offset < size; partNumber, offset = partNumber+1, offset+partSize {
+		n := size - offset
+		if n > partSize {
+			n = partSize
+		}
+		data := u.buffer()[:n]
+		if _, err := io.ReadFull(io.NewSectionReader(r, offset, n), data); err != nil {
+			return u.abort(err)
+		}
+		if err := u.uploadPart(partNumber, data); err != nil {
+			return u.abort(err)
+		}
+	}
+	if err := u.complete(ret); err != nil {
+		return u.abort(err)
+	}
+	return nil
+}
+
+// uploadFile uploads the local file at path with the SDK, which records the
+// progress with the recorder of the bucket and resumes the upload from it.
+// The SDK never aborts the upload, so that it can be resumed from the record.
+func (u *multipartUpload) uploadFile(path string, size int64, ret interface{}) error {
+	defer u.cancel()
+	extra, err := u.sizedExtra(size)
+	if err != nil {
+		return err
+	}
+	extra.Recorder = u.b.recorder
+	if !u.hasKey {
+		return u.uploader.PutFileWithoutKey(u.ctx, ret, u.upToken, path, &extra)
+	}
+	return u.uploader.PutFile(u.ctx, ret, u.upToken, u.key, path, &extra)
+}
+
+// sizedExtra returns the extra for the SDK to upload the local file of the
+// known size, the progress is reported once a part is uploaded. The SDK retries and
+// freezes the hosts by itself without backoff, it has no hook for the retry
+// interval of the bucket, and only the transfer acceleration hosts unknown to it
+// are picked here.
+func (u *multipartUpload) sizedExtra(size int64) (storage.RputV2Extra, error) {
+	u.setTotalBytes(size)
+	extra := u.extra
+	extra.PartSize = int64(u.partSize)
+	extra.TryTimes = u.b.retryPolicy.tryTimes
+	extra.HostFreezeDuration = u.b.hostFreezer.duration
+	if u.b.upHostType == upHostTypeAcc {
+		upHosts, err := u.b.upHosts(u.ctx)
+		if err != nil {
+			return extra, err
+		}
+		extra.UpHost = u.b.hostFreezer.pick(upHosts, 0)
+	}
+	extra.Notify = func(partNumber int64, _ *storage.UploadPartsRet) {
+		partSize := size - (partNumber-1)*extra.PartSize
+		if partSize > extra.PartSize {
+			partSize = extra.PartSize
+		}
+		u.addProgress(partSize, 1, "")
+	}
+	return extra, nil
+}
+
+// formUpload uploads data as the whole object in a single form upload request
+// with its size and CRC32, which saves the requests of multipart upload for
+// small objects, see https://developer.qiniu.com/kodo/1312/upload
+// The request is built here instead of by the SDK form uploader, which retries
+// by itself and hides the status code of the last error.
+func (u *multipartUpload) formUpload(data io.ReadSeeker, size int64, ret interface{}) error {
+	defer u.cancel()
+	if err := u.error(); err != nil {
+		return err
+	}
+	if err := u.ctx.Err(); err != nil {
+		return err
+	}
+	upHosts, err := u.b.upHosts(u.ctx)
+	if err != nil {
+		return err
+	}
+	u.upHosts = upHosts
+	crc32Hash := crc32.NewIEEE()
+	if _, err = io.Copy(crc32Hash, data); err != nil {
+		return err
+	}
+	var head bytes.Buffer
+	formWriter := multipart.NewWriter(&head)
+	fields := map[string]string{"token": u.upToken, "crc32": fmt.Sprintf("%010d", crc32Hash.Sum32())}
+	fileName := "filename"
+	if u.hasKey {
+		fields["key"] = u.key
+		fileName = path.Base(u.key)
+	}
+	for k, v := range u.extra.Metadata {
+		fields[k] = v
+	}
+	for k, v := range u.extra.CustomVars {
+		fields[k] = v
+	}
+	for k, v := range fields {
+		if v != "" {
+			if err = formWriter.WriteField(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	fileHeader := textproto.MIMEHeader{"Content-Disposition": {fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(fileName))}}
+	if u.extra.MimeType != "" {
+		fileHeader.Set("Content-Type", u.extra.MimeType)
+	}
+	if _, err = formWriter.CreatePart(fileHeader); err != nil {
+		return err
+	}
+	tail := "\r\n--" + formWriter.Boundary() + "--\r\n"
+	headers := http.Header{"Content-Type": {formWriter.FormDataContentType()}}
+
+	u.setTotalBytes(size)
+	var lastUpHost string
+	if err = u.withRetries(func(upHost string) error {
+		lastUpHost = upHost
+		if _, err := data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		body := io.MultiReader(bytes.NewReader(head.Bytes()), data, strings.NewReader(tail))
+		return u.uploader.Client.CallWith64(u.ctx, ret, http.MethodPost, upHost, headers, body, int64(head.Len())+size+int64(len(tail)))
+	}); err != nil {
+		return err
+	}
+	u.addProgress(size, 0, lastUpHost)
+	return nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// abort fails the upload with err, waits for the parts being uploaded and
+// aborts the upload to delete the uploaded parts. The first error of the
+// upload is returned.
+func (u *multipartUpload) abort(err error) error {
+	u.setError(err)
+	u.wg.Wait()
+	if u.uploadId != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		encodedKey := "~"
+		if u.hasKey {
+			encodedKey = base64.URLEncoding.EncodeToString([]byte(u.key))
+		}
+		abortUrl := u.upHosts[0] + "/buckets/" + u.b.name + "/objects/" + encodedKey + "/uploads/" + u.uploadId
+		_ = u.uploader.Client.Call(ctx, nil, http.MethodDelete, abortUrl, http.Header{"Authorization": {"UpToken " + u.upToken}})
+	}
+	return u.error()
+}
+
+func (u *multipartUpload) setTotalBytes(size int64) {
+	u.progressLock.Lock()
+	defer u.progressLock.Unlock()
+	u.progress.TotalBytes = size
+}
+
+func (u *multipartUpload) addProgress(bytes int64, parts int, upHost string) {
+	if u.onProgress == nil {
+		return
+	}
+	u.progressLock.Lock()
+	defer u.progressLock.Unlock()
+	u.progress.UploadedBytes += bytes
+	u.progress.UploadedParts += parts
+	if upHost != "" {
+		u.progress.UpHost = upHost
+	}
+	u.onProgress(u.progress)
+}
+
+func (u *multipartUpload) error() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.err
+}
+
+func (u *multipartUpload) setError(err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.err == nil {
+		u.err = err
+		u.cancel()
+	}
+}
+
+// withRetries calls f with the upload hosts until it succeeds or the error is
+// not retryable. The host failing with a retryable error is frozen and the
+// retries are backed off by the retry policy of the bucket.
+func (u *multipartUpload) withRetries(f func(upHost string) error) (err error) {
+	policy := u.b.retryPolicy
+	for i := 0; i < policy.tryTimes; i++ {
+		if i > 0 {
+			if err := policy.wait(u.ctx, i); err != nil {
+				return err
+			}
+		}
+		upHost := u.b.hostFreezer.pick(u.upHosts, i)
+		if err = f(upHost); err == nil || !isRetryableError(err) || u.ctx.Err() != nil {
+			return
+		}
+		u.b.hostFreezer.freeze(upHost)
+	}
+	return
+}
+
+func isRetryableError(err error) bool {
+	var errorInfo *client.ErrorInfo
+	if errors.As(err, &errorInfo) {
+		return errorInfo.Code >= 500 && errorInfo.Code != 579 && errorInfo.Code < 600
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,100 @@
+package kodoblob
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+var ErrOverlappingPrefixes = errors.New("kodoblob: prefixes of rename must not contain each other")
+
+// RenamePrefixOptions controls RenamePrefix.
+type RenamePrefixOptions struct {
+	// Workers is the max number of concurrent batch requests, see Batch.
+	Workers int
+	// Overwrite overwrites the existing destinations, otherwise the objects
+	// whose destinations exist are kept and reported as conflicts.
+	Overwrite bool
+	// Checkpoint resumes an interrupted rename from the Checkpoint of its
+	// last RenamePrefixProgress, the keys not after it are skipped.
+	Checkpoint string
+	// OnProgress is called serially once a batch of objects is renamed and
+	// all batches before it are renamed.
+	OnProgress func(RenamePrefixProgress)
+	// OnConflict is called serially with the keys of each object that is not
+	// renamed because the destination exists.
+	OnConflict func(srcKey, dstKey string)
+}
+
+// RenamePrefixProgress is the progress of RenamePrefix.
+type RenamePrefixProgress struct {
+	// Moved and Conflicts are the numbers of objects renamed and not renamed
+	// because of conflicts.
+	Moved     int
+	Conflicts int
+	// Checkpoint is the last key under the old prefix before which all
+	// objects are renamed or reported as conflicts, it is the Checkpoint of
+	// RenamePrefixOptions if no batch is done.
+	Checkpoint string
+}
+
+// RenamePrefix renames all objects under oldPrefix of the kodoblob bucket to
+// newPrefix by batch moves while listing them, see Batch. Each object is moved
+// atomically by Kodo, so an interrupted rename never loses objects, the objects
+// left under oldPrefix can be renamed by calling RenamePrefix again, from the
+// Checkpoint of the last progress to skip the conflicts reported.
+//
+// It returns the final progress and the first error of listing or moving, the
+// objects not found are skipped as they may be renamed or deleted by others.
+func RenamePrefix(ctx context.Context, bucket *blob.Bucket, oldPrefix, newPrefix string, opts *RenamePrefixOptions) (RenamePrefixProgress, error) {
+	var progress RenamePrefixProgress
+	if strings.HasPrefix(oldPrefix, newPrefix) || strings.HasPrefix(newPrefix, oldPrefix) {
+		return progress, ErrOverlappingPrefixes
+	}
+	if opts == nil {
+		opts = &RenamePrefixOptions{}
+	}
+	progress.Checkpoint = opts.Checkpoint
+	var (
+		nextSeq     int
+		checkpoints = make(map[int]string)
+	)
+	err := batchPrefix(ctx, bucket, oldPrefix, opts.Checkpoint, opts.Workers, func(key string) BatchOperation {
+		return BatchOperation{Op: BatchMove, Key: key, DstKey: newPrefix + strings.TrimPrefix(key, oldPrefix), Overwrite: opts.Overwrite}
+	}, func(seq int, ops []BatchOperation, results []BatchResult) error {
+		for i, result := range results {
+			switch result.Code {
+			case gcerrors.OK:
+				progress.Moved++
+			case gcerrors.AlreadyExists:
+				progress.Conflicts++
+				if opts.OnConflict != nil {
+					opts.OnConflict(ops[i].Key, ops[i].DstKey)
+				}
+			case gcerrors.NotFound:
+			default:
+				return result.Err
+			}
+		}
+		// The batches may be done out of order, the checkpoint only advances
+		// over the consecutive batches done.
+		checkpoints[seq] = ops[len(ops)-1].Key
+		for {
+			checkpoint, ok := checkpoints[nextSeq]
+			if !ok {
+				break
+			}
+			delete(checkpoints, nextSeq)
+			progress.Checkpoint = checkpoint
+			nextSeq++
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(progress)
+		}
+		return nil
+	})
+	return progress, err
+}
@@ -0,0 +1,103 @@
+package kodoblob
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUploadTryTimes         = 3
+	defaultUploadRetryInterval    = 500 * time.Millisecond
+	defaultUploadRetryMaxInterval = 10 * time.Second
+	defaultHostFreezeDuration     = 10 * time.Minute
+)
+
+// Upload host types of the upHostType URL option, the hosts of the preferred
+// type are tried first and the others are kept for failover.
+const (
+	upHostTypeCdn = "cdn"
+	upHostTypeSrc = "src"
+	upHostTypeAcc = "acc"
+)
+
+// retryPolicy retries the upload and management requests with exponential
+// backoff and jitter.
+type retryPolicy struct {
+	tryTimes    int
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+// backoff returns the time to wait before the retry numbered retry, which
+// starts from 1. The interval doubles per retry up to maxInterval, and a random
+// half of it is waited, so that the parts failing together do not retry in
+// lockstep.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	interval := p.interval
+	for i := 1; i < retry && interval < p.maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > p.maxInterval {
+		interval = p.maxInterval
+	}
+	if interval <= 0 {
+		return 0
+	}
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+// wait waits for the backoff of the retry numbered retry or until ctx is done.
+func (p retryPolicy) wait(ctx context.Context, retry int) error {
+	timer := time.NewTimer(p.backoff(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostFreezer freezes the upload hosts failing with retryable errors, so that
+// the later requests of all writers of the bucket prefer the other hosts.
+type hostFreezer struct {
+	duration time.Duration
+
+	lock   sync.Mutex
+	frozen map[string]time.Time
+}
+
+func newHostFreezer(duration time.Duration) *hostFreezer {
+	return &hostFreezer{duration: duration, frozen: make(map[string]time.Time)}
+}
+
+// pick returns the host for the try numbered try, the hosts not frozen are
+// picked in turn, so that the retries fail over even if no host is frozen, or
+// all the hosts in turn if all of them are frozen.
+func (f *hostFreezer) pick(hosts []string, try int) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	available := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if until, ok := f.frozen[host]; !ok || now.After(until) {
+			delete(f.frozen, host)
+			available = append(available, host)
+		}
+	}
+	if len(available) == 0 {
+		available = hosts
+	}
+	return available[try%len(available)]
+}
+
+func (f *hostFreezer) freeze(host string) {
+	if f.duration <= 0 {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.frozen[host] = time.Now().Add(f.duration)
+}
@@ -0,0 +1,236 @@
+package kodoblob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/storage"
+)
+
+const (
+	s3SignAlgorithm    = "AWS4-HMAC-SHA256"
+	s3Service          = "s3"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3DateFormat       = "20060102"
+	s3TimeFormat       = "20060102T150405Z"
+	s3MaxSignedExpires = 7 * 24 * time.Hour
+)
+
+// s3RegionAliases maps Kodo region IDs to the region names used by the
+// Kodo S3-compatible API. Region IDs not listed here are used as is.
+var s3RegionAliases = map[string]string{
+	"z0":  "cn-east-1",
+	"z1":  "cn-north-1",
+	"z2":  "cn-south-1",
+	"na0": "us-north-1",
+	"as0": "ap-southeast-1",
+}
+
+func s3RegionFromRegionID(regionID string) string {
+	if alias, ok := s3RegionAliases[regionID]; ok {
+		return alias
+	}
+	return regionID
+}
+
+func s3EndpointFromRegion(s3Region string, useHttps bool) (*url.URL, error) {
+	return parseEndpoint("s3."+s3Region+".qiniucs.com", useHttps)
+}
+
+func parseEndpoint(host string, useHttps bool) (*url.URL, error) {
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		if useHttps {
+			host = "https://" + host
+		} else {
+			host = "http://" + host
+		}
+	}
+	return url.Parse(host)
+}
+
+// s3Endpoint returns the S3-compatible endpoint and region of the bucket,
+// querying the bucket region with ctx if neither was configured explicitly.
+// The query is made without holding s3Lock, so that a slow query does not
+// block the other signers, which may query concurrently.
+func (b *bucket) s3Endpoint(ctx context.Context) (*url.URL, string, error) {
+	b.s3Lock.Lock()
+	endpoint, region := b.s3EndpointUrl, b.s3Region
+	b.s3Lock.Unlock()
+	if endpoint != nil && region != "" {
+		return endpoint, region, nil
+	}
+	if region == "" {
+		regionID, err := b.bucketRegionID(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		region = s3RegionFromRegionID(regionID)
+	}
+	if endpoint == nil {
+		var err error
+		if endpoint, err = s3EndpointFromRegion(region, b.preferHttps); err != nil {
+			return nil, "", err
+		}
+	}
+
+	b.s3Lock.Lock()
+	defer b.s3Lock.Unlock()
+	b.s3EndpointUrl, b.s3Region = endpoint, region
+	return endpoint, region, nil
+}
+
+// bucketRegionID queries the region ID of the bucket, which is aborted once
+// ctx is done as the SDK does not take a context for the query.
+func (b *bucket) bucketRegionID(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	type bucketInfoResult struct {
+		info storage.BucketInfo
+		err  error
+	}
+	c := make(chan bucketInfoResult, 1)
+	go func() {
+		info, err := b.bucketManager.GetBucketInfo(b.name)
+		c <- bucketInfoResult{info: info, err: err}
+	}()
+	select {
+	case result := <-c:
+		if result.err != nil {
+			return "", result.err
+		}
+		if result.info.Region == "" {
+			return "", ErrNoS3Region
+		}
+		return result.info.Region, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (b *bucket) signS3Url(ctx context.Context, method, key string, opts *s3SignOptions) (string, error) {
+	endpoint, region, err := b.s3Endpoint(ctx)
+	if err != nil {
+		return "", err
+	}
+	if opts.expiry > s3MaxSignedExpires {
+		opts.expiry = s3MaxSignedExpires
+	}
+	u := *endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.name + "/" + key
+	u.RawPath = ""
+	u.RawQuery = ""
+	return presignS3Url(method, &u, region, b.credentials.AccessKey, string(b.credentials.SecretKey), opts), nil
+}
+
+type s3SignOptions struct {
+	signedAt time.Time
+	expiry   time.Duration
+	headers  http.Header
+}
+
+// presignS3Url generates an AWS Signature Version 4 query string signed URL,
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presignS3Url(method string, u *url.URL, region, accessKey, secretKey string, opts *s3SignOptions) string {
+	signedAt := opts.signedAt.UTC()
+	if signedAt.IsZero() {
+		signedAt = time.Now().UTC()
+	}
+	var (
+		date          = signedAt.Format(s3DateFormat)
+		scope         = strings.Join([]string{date, region, s3Service, "aws4_request"}, "/")
+		headerNames   = []string{"host"}
+		headerValues  = map[string]string{"host": u.Host}
+		canonicalPath = s3EscapePath(u.Path)
+	)
+	for name, values := range opts.headers {
+		name = strings.ToLower(name)
+		headerNames = append(headerNames, name)
+		headerValues[name] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	sort.Strings(headerNames)
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", s3SignAlgorithm)
+	query.Set("X-Amz-Credential", accessKey+"/"+scope)
+	query.Set("X-Amz-Date", signedAt.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(opts.expiry/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+	canonicalQuery := s3EscapeQuery(query)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name)
+		canonicalHeaders.WriteByte(':')
+		canonicalHeaders.WriteString(headerValues[name])
+		canonicalHeaders.WriteByte('\n')
+	}
+	canonicalRequest := strings.Join([]string{
+		method, canonicalPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, s3UnsignedPayload,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm, signedAt.Format(s3TimeFormat), scope, hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", u.Scheme, u.Host, canonicalPath, canonicalQuery, signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3EscapeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape URI-encodes every byte except the unreserved characters, as
+// required by Signature Version 4. Slashes are kept unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
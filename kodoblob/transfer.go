@@ -0,0 +1,118 @@
+package kodoblob
+
+import (
+	"context"
+	"errors"
+
+	"github.com/qiniu/go-sdk/v7/storage"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+var ErrDifferentAccounts = errors.New("kodoblob: buckets belong to different accounts")
+
+// CopyBetween copies srcKey of srcBucket to dstKey of dstBucket by the server
+// side copy of Kodo, both buckets must be kodoblob buckets of the same account,
+// and Kodo requires them to be in the same region. opts may be nil, see
+// CopyOptions.
+//
+// The errors are not wrapped by the blob package, use ErrorCode to get their
+// error codes.
+func CopyBetween(ctx context.Context, srcBucket *blob.Bucket, srcKey string, dstBucket *blob.Bucket, dstKey string, opts *CopyOptions) error {
+	return transferBetween(ctx, srcBucket, srcKey, dstBucket, dstKey, false, opts)
+}
+
+// MoveBetween is like CopyBetween, but moves the object by the server side move
+// of Kodo, which deletes srcKey once it is copied.
+func MoveBetween(ctx context.Context, srcBucket *blob.Bucket, srcKey string, dstBucket *blob.Bucket, dstKey string, opts *CopyOptions) error {
+	return transferBetween(ctx, srcBucket, srcKey, dstBucket, dstKey, true, opts)
+}
+
+// Move renames srcKey of the kodoblob bucket to dstKey by the server side move
+// of Kodo, it fails with gcerrors.AlreadyExists if dstKey exists and overwrite
+// is false, and with gcerrors.NotFound if srcKey does not exist, see ErrorCode.
+func Move(ctx context.Context, bucket *blob.Bucket, srcKey, dstKey string, overwrite bool) error {
+	b, err := kodoBucket(bucket)
+	if err != nil {
+		return err
+	}
+	return transfer(ctx, b, srcKey, b, dstKey, true, &CopyOptions{NoOverwrite: !overwrite})
+}
+
+// ErrorCode returns the error code of the errors returned by the functions of
+// this package, which are not wrapped by the blob package.
+func ErrorCode(err error) gcerrors.ErrorCode {
+	return (*bucket)(nil).ErrorCode(err)
+}
+
+func transferBetween(ctx context.Context, srcBucket *blob.Bucket, srcKey string, dstBucket *blob.Bucket, dstKey string, move bool, opts *CopyOptions) error {
+	src, err := kodoBucket(srcBucket)
+	if err != nil {
+		return err
+	}
+	dst, err := kodoBucket(dstBucket)
+	if err != nil {
+		return err
+	}
+	if src.credentials.AccessKey != dst.credentials.AccessKey {
+		return ErrDifferentAccounts
+	}
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	return transfer(ctx, src, srcKey, dst, dstKey, move, opts)
+}
+
+// transfer copies or moves srcKey of src to dstKey of dst, then applies the
+// replacements of opts to dstKey.
+func transfer(ctx context.Context, src *bucket, srcKey string, dst *bucket, dstKey string, move bool, opts *CopyOptions) error {
+	uri := storage.URICopy(src.name, srcKey, dst.name, dstKey, !opts.NoOverwrite)
+	if move {
+		uri = storage.URIMove(src.name, srcKey, dst.name, dstKey, !opts.NoOverwrite)
+	}
+	retried, err := src.manage(ctx, uri, nil)
+	if retried && err != nil {
+		// The failed attempt before the retry may have copied or moved the
+		// object, which fails the retry if the destination exists or the
+		// source is moved.
+		if done, statErr := transferred(ctx, src, srcKey, dst, dstKey, move, err); statErr == nil && done {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if opts.ContentType != "" || len(opts.Metadata) > 0 {
+		uri := storage.URIChangeMimeAndMeta(dst.name, dstKey, opts.ContentType, convertMetadataToParams(opts.Metadata))
+		if _, err = dst.manage(ctx, uri, nil); err != nil {
+			return err
+		}
+	}
+	if opts.FileType != nil {
+		if _, err = dst.manage(ctx, storage.URIChangeType(dst.name, dstKey, *opts.FileType), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferred reports whether the object is already copied or moved when the
+// retry fails with err.
+func transferred(ctx context.Context, src *bucket, srcKey string, dst *bucket, dstKey string, move bool, err error) (bool, error) {
+	code := ErrorCode(err)
+	if code != gcerrors.AlreadyExists && !(move && code == gcerrors.NotFound) {
+		return false, nil
+	}
+	var srcInfo, dstInfo storage.FileInfo
+	_, srcErr := src.manage(ctx, storage.URIStat(src.name, srcKey), &srcInfo)
+	if move && ErrorCode(srcErr) != gcerrors.NotFound || !move && srcErr != nil {
+		return false, srcErr
+	}
+	if _, err := dst.manage(ctx, storage.URIStat(dst.name, dstKey), &dstInfo); err != nil {
+		return false, err
+	}
+	if move {
+		return true, nil
+	}
+	return srcInfo.Hash == dstInfo.Hash, nil
+}
@@ -0,0 +1,89 @@
+package kodoblob
+
+import (
+	"context"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"gocloud.dev/blob"
+)
+
+// UploadFile uploads the local file at path to key of the kodoblob bucket.
+// If opts.ContentType is empty, it is guessed from the file extension. The
+// size of the file is known before uploading, so a small file is uploaded in a
+// single form upload, and the parts of a large file are read while the previous
+// ones are being uploaded, which are aborted if the upload fails.
+//
+// If the bucket is opened with recorderDir, a large file is uploaded by the SDK
+// instead, which records the upload progress there, so uploading the same
+// unmodified file to the same key again after an interruption, even in another
+// process, only uploads the remaining parts. The record is removed once the
+// upload succeeds, and the failed upload is never aborted to be resumed.
+func UploadFile(ctx context.Context, bucket *blob.Bucket, key, path string, opts *blob.WriterOptions) error {
+	if _, err := kodoBucket(bucket); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var options blob.WriterOptions
+	if opts != nil {
+		options = *opts
+	}
+	if options.ContentType == "" {
+		if options.ContentType = mime.TypeByExtension(filepath.Ext(path)); options.ContentType == "" {
+			options.ContentType = "application/octet-stream"
+		}
+	}
+	return bucket.Upload(ctx, key, file, driverContentMD5(&options))
+}
+
+// UploadReaderAt uploads size bytes read from r to key of the kodoblob bucket,
+// the parts are read and uploaded like UploadFile without recorderDir.
+// opts.ContentType is required, and it fails with ErrNegativeSize, whose error
+// code is gcerrors.InvalidArgument, if size is negative.
+//
+// Unlike Bucket.Upload, which does not support opts.ContentMD5 for the sources
+// of known sizes, UploadFile and UploadReaderAt verify it before uploading.
+func UploadReaderAt(ctx context.Context, bucket *blob.Bucket, key string, r io.ReaderAt, size int64, opts *blob.WriterOptions) error {
+	if _, err := kodoBucket(bucket); err != nil {
+		return err
+	}
+	if size < 0 {
+		return ErrNegativeSize
+	}
+	var options blob.WriterOptions
+	if opts != nil {
+		options = *opts
+	}
+	return bucket.Upload(ctx, key, io.NewSectionReader(r, 0, size), driverContentMD5(&options))
+}
+
+// driverContentMD5 moves ContentMD5 of opts to WriteOptions, so that it is
+// verified by the driver before uploading. The blob package only verifies the
+// content written through the writer, to which the sources of known sizes are
+// not written.
+func driverContentMD5(opts *blob.WriterOptions) *blob.WriterOptions {
+	contentMD5 := opts.ContentMD5
+	if len(contentMD5) == 0 {
+		return opts
+	}
+	opts.ContentMD5 = nil
+	beforeWrite := opts.BeforeWrite
+	opts.BeforeWrite = func(asFunc func(interface{}) bool) error {
+		var writeOptions *WriteOptions
+		if asFunc(&writeOptions) {
+			writeOptions.contentMD5 = contentMD5
+		}
+		if beforeWrite != nil {
+			return beforeWrite(asFunc)
+		}
+		return nil
+	}
+	return opts
+}
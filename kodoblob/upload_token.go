@@ -0,0 +1,214 @@
+package kodoblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/storage"
+	"gocloud.dev/blob"
+)
+
+const defaultUploadTokenExpiry = time.Hour
+
+var (
+	ErrNotKodoBucket  = errors.New("kodoblob: not a kodoblob bucket")
+	ErrNoUploadDomain = errors.New("kodoblob: no upload domain provided")
+)
+
+// FormUploadOptions controls the upload token created by SignFormUpload.
+type FormUploadOptions struct {
+	// Key is the object key the token allows to upload, or the key prefix if
+	// IsPrefixalScope is set. An empty Key allows uploading to any key of the
+	// bucket, but only new objects can be created.
+	Key string
+	// IsPrefixalScope allows uploading to any key starting with Key,
+	// existing objects can not be overwritten in this mode.
+	IsPrefixalScope bool
+	// Expiry sets how long the upload token is valid for, default is one hour.
+	Expiry time.Duration
+	// InsertOnly disallows overwriting the existing object.
+	InsertOnly bool
+	// FsizeMin and FsizeLimit limit the size of uploaded object in bytes.
+	FsizeMin   int64
+	FsizeLimit int64
+	// MimeLimit limits the MIME types of uploaded object, e.g. "image/*" or
+	// "image/jpeg;image/png" or "!application/json;text/plain".
+	MimeLimit string
+	// ReturnURL is the URL the browser will be redirected to (with 303) after
+	// upload, ReturnBody is the custom response body in JSON, magic variables
+	// like $(key) and $(etag) are supported.
+	ReturnURL  string
+	ReturnBody string
+	// CallbackURL is called by Kodo with CallbackBody after upload, the response
+	// from it is returned to the browser.
+	CallbackURL      string
+	CallbackHost     string
+	CallbackBody     string
+	CallbackBodyType string
+	// BeforeSign is a callback that will be called before the upload token is
+	// signed, asFunc converts its argument to *storage.PutPolicy.
+	BeforeSign func(asFunc func(interface{}) bool) error
+}
+
+// FormUpload contains everything a browser needs to upload an object
+// directly to Kodo by form upload, see
+// https://developer.qiniu.com/kodo/1312/upload
+type FormUpload struct {
+	// URL is the URL the form should be posted to.
+	URL string
+	// Token is the upload token.
+	Token string
+	// Fields are the form fields must be posted along with the file field,
+	// the token field is always included, the key field is included if the
+	// token is limited to a single key.
+	Fields map[string]string
+	// Expiry is the time when the upload token expires.
+	Expiry time.Time
+}
+
+// SignFormUpload creates an upload token for the given kodoblob bucket and
+// returns it along with the form upload URL and fields for a browser.
+func SignFormUpload(ctx context.Context, bucket *blob.Bucket, opts *FormUploadOptions) (*FormUpload, error) {
+	b, err := kodoBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &FormUploadOptions{}
+	}
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = defaultUploadTokenExpiry
+	}
+	putPolicy := storage.PutPolicy{
+		Scope:            b.name,
+		Expires:          uint64(expiry / time.Second),
+		FsizeMin:         opts.FsizeMin,
+		FsizeLimit:       opts.FsizeLimit,
+		MimeLimit:        opts.MimeLimit,
+		ReturnURL:        opts.ReturnURL,
+		ReturnBody:       opts.ReturnBody,
+		CallbackURL:      opts.CallbackURL,
+		CallbackHost:     opts.CallbackHost,
+		CallbackBody:     opts.CallbackBody,
+		CallbackBodyType: opts.CallbackBodyType,
+	}
+	if opts.Key != "" || opts.IsPrefixalScope {
+		putPolicy.Scope = fmt.Sprintf("%s:%s", b.name, opts.Key)
+	}
+	if opts.IsPrefixalScope {
+		putPolicy.IsPrefixalScope = 1
+	}
+	if opts.InsertOnly {
+		putPolicy.InsertOnly = 1
+	}
+	if opts.BeforeSign != nil {
+		asFunc := func(i interface{}) bool {
+			if p, ok := i.(**storage.PutPolicy); ok {
+				*p = &putPolicy
+				return true
+			}
+			return false
+		}
+		if err = opts.BeforeSign(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	uploadUrl, err := b.formUploadUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(time.Duration(putPolicy.Expires) * time.Second)
+	token := putPolicy.UploadToken(b.credentials)
+	fields := map[string]string{"token": token}
+	if opts.Key != "" && !opts.IsPrefixalScope {
+		fields["key"] = opts.Key
+	}
+	return &FormUpload{
+		URL:    uploadUrl.String(),
+		Token:  token,
+		Fields: fields,
+		Expiry: expiresAt,
+	}, nil
+}
+
+func (b *bucket) formUploadUrl(ctx context.Context) (*url.URL, error) {
+	upHosts, err := b.upHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(upHosts[0])
+}
+
+// region returns the region of the bucket, which is queried if not configured.
+// The query of the SDK can not be cancelled, it returns once ctx is done and
+// leaves the query to finish in background, whose result is cached by the SDK.
+func (b *bucket) region(ctx context.Context) (*storage.Region, error) {
+	if b.config.Region != nil {
+		return b.config.Region, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type regionResult struct {
+		region *storage.Region
+		err    error
+	}
+	c := make(chan regionResult, 1)
+	go func() {
+		region, err := storage.GetRegionWithOptions(b.credentials.AccessKey, b.name, storage.UCApiOptions{UseHttps: b.preferHttps})
+		c <- regionResult{region: region, err: err}
+	}()
+	select {
+	case result := <-c:
+		return result.region, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// upHosts returns the upload URLs of the bucket region, the ones of upHostType
+// come first, which are the CDN accelerated ones by default.
+func (b *bucket) upHosts(ctx context.Context) ([]string, error) {
+	region, err := b.region(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	switch b.upHostType {
+	case upHostTypeSrc:
+		hosts = append(append(hosts, region.SrcUpHosts...), region.CdnUpHosts...)
+	case upHostTypeAcc:
+		hosts = append(append(append(hosts, b.accUpHosts...), region.CdnUpHosts...), region.SrcUpHosts...)
+	default:
+		hosts = append(append(hosts, region.CdnUpHosts...), region.SrcUpHosts...)
+	}
+	upHosts := make([]string, 0, len(hosts))
+	seen := make(map[string]bool, len(hosts))
+	for _, upHost := range hosts {
+		upUrl, err := parseEndpoint(upHost, b.preferHttps)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[upUrl.String()] {
+			seen[upUrl.String()] = true
+			upHosts = append(upHosts, upUrl.String())
+		}
+	}
+	if len(upHosts) == 0 {
+		return nil, ErrNoUploadDomain
+	}
+	return upHosts, nil
+}
+
+// kodoBucket returns the underlying kodoblob bucket of the portable bucket.
+func kodoBucket(blobBucket *blob.Bucket) (*bucket, error) {
+	var b *bucket
+	if blobBucket == nil || !blobBucket.As(&b) {
+		return nil, ErrNotKodoBucket
+	}
+	return b, nil
+}
@@ -0,0 +1,196 @@
+package kodoblob
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/qiniu/go-sdk/v7/storage"
+)
+
+// WriteOptions controls the upload policy of objects written by the kodoblob
+// writer, see https://developer.qiniu.com/kodo/1206/put-policy
+//
+// The defaults are set by the URL options of the bucket, they can be changed
+// per write by WriterOptions.BeforeWrite, whose asFunc converts its argument to
+// **WriteOptions, or to **storage.PutPolicy for the fields not covered here.
+type WriteOptions struct {
+	// InsertOnly disallows overwriting the existing object.
+	InsertOnly bool
+	// FileType is the storage class of the object, 0 for standard, 1 for
+	// infrequent access, 2 for archive, 3 for deep archive.
+	FileType int
+	// DeleteAfterDays deletes the object after the given days if it is
+	// positive.
+	DeleteAfterDays int
+	// DetectMime lets Kodo detect the MIME type of the object by its content
+	// instead of using the content type of the writer.
+	DetectMime bool
+	// FsizeMin and FsizeLimit limit the size of the object in bytes.
+	FsizeMin   int64
+	FsizeLimit int64
+	// MimeLimit limits the MIME types of the object, e.g. "image/*" or
+	// "image/jpeg;image/png" or "!application/json;text/plain".
+	MimeLimit string
+	// EndUser is the unique ID of the end user who uploads the object.
+	EndUser string
+	// PersistentOps are the persistent data processing commands triggered
+	// after upload, separated by ";", PersistentPipeline is the queue to run
+	// them, and PersistentNotifyURL receives the processing results.
+	PersistentOps       string
+	PersistentPipeline  string
+	PersistentNotifyURL string
+	// ReturnBody is the custom response body of the upload, e.g.
+	// `{"key":"$(key)","hash":"$(etag)","fsize":$(fsize)}`.
+	ReturnBody string
+	// CallbackURL receives a POST request with CallbackBody of
+	// CallbackBodyType after the object is uploaded, and its response becomes
+	// the response of the upload instead of ReturnBody. Multiple URLs are
+	// separated by ";", CallbackHost overrides the Host header of the request.
+	CallbackURL      string
+	CallbackHost     string
+	CallbackBody     string
+	CallbackBodyType string
+	// SaveKey lets Kodo name the object by the template, e.g.
+	// "images/$(etag)$(ext)", if the object is written with an empty key or
+	// ForceSaveKey is set. The final key is reported by OnComplete.
+	SaveKey      string
+	ForceSaveKey bool
+	// OnComplete is called with the response of the upload once the object
+	// is uploaded, before the writer is closed.
+	OnComplete func(UploadResult)
+	// OnProgress is called after each part or the whole object is uploaded.
+	// It may be called from different goroutines, but never concurrently.
+	OnProgress func(Progress)
+
+	// contentMD5 is the ContentMD5 verified by the driver, which is set by
+	// UploadFile and UploadReaderAt, as the blob package does not verify the
+	// content uploaded by the driver.
+	contentMD5 []byte
+}
+
+// UploadResult is the response of an upload reported to
+// WriteOptions.OnComplete.
+type UploadResult struct {
+	// Key and Hash are decoded from Body, they are empty if Body is customized
+	// by ReturnBody or the callback without them.
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+	// Body is the raw JSON response body.
+	Body json.RawMessage `json:"-"`
+}
+
+// Progress is the progress of an upload reported to WriteOptions.OnProgress.
+type Progress struct {
+	// UploadedBytes is the number of bytes uploaded.
+	UploadedBytes int64
+	// UploadedParts is the number of parts uploaded, it is 0 if the object is
+	// uploaded in a single form upload.
+	UploadedParts int
+	// TotalBytes is the size of the object, or -1 if it is unknown until the
+	// writer is closed.
+	TotalBytes int64
+	// UpHost is the upload host the last part was uploaded to, it is empty
+	// for the parts uploaded by the SDK.
+	UpHost string
+}
+
+func (o *urlSessionOpener) createWriteOptions(query url.Values) (*WriteOptions, error) {
+	var (
+		writeOptions WriteOptions
+		err          error
+	)
+	if writeOptions.InsertOnly, err = o.parseBoolOption(query, "insertOnly"); err != nil {
+		return nil, err
+	}
+	if writeOptions.DetectMime, err = o.parseBoolOption(query, "detectMime"); err != nil {
+		return nil, err
+	}
+	if writeOptions.ForceSaveKey, err = o.parseBoolOption(query, "forceSaveKey"); err != nil {
+		return nil, err
+	}
+	if writeOptions.FileType, err = o.parseIntOption(query, "fileType", 0, 0); err != nil {
+		return nil, err
+	}
+	if writeOptions.DeleteAfterDays, err = o.parseIntOption(query, "deleteAfterDays", 0, 0); err != nil {
+		return nil, err
+	}
+	fsizeMin, err := o.parseIntOption(query, "fsizeMin", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	fsizeLimit, err := o.parseIntOption(query, "fsizeLimit", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	writeOptions.FsizeMin = int64(fsizeMin)
+	writeOptions.FsizeLimit = int64(fsizeLimit)
+	writeOptions.MimeLimit = query.Get("mimeLimit")
+	writeOptions.EndUser = query.Get("endUser")
+	writeOptions.PersistentOps = query.Get("persistentOps")
+	writeOptions.PersistentPipeline = query.Get("persistentPipeline")
+	writeOptions.PersistentNotifyURL = query.Get("persistentNotifyUrl")
+	writeOptions.ReturnBody = query.Get("returnBody")
+	writeOptions.CallbackURL = query.Get("callbackUrl")
+	writeOptions.CallbackHost = query.Get("callbackHost")
+	writeOptions.CallbackBody = query.Get("callbackBody")
+	writeOptions.CallbackBodyType = query.Get("callbackBodyType")
+	writeOptions.SaveKey = query.Get("saveKey")
+	return &writeOptions, nil
+}
+
+// applyTo sets the non-zero options to the upload policy, leaving the fields
+// set by BeforeWrite through *storage.PutPolicy untouched otherwise.
+func (opts *WriteOptions) applyTo(putPolicy *storage.PutPolicy) {
+	if opts.InsertOnly {
+		putPolicy.InsertOnly = 1
+	}
+	if opts.DetectMime {
+		putPolicy.DetectMime = 1
+	}
+	if opts.FileType != 0 {
+		putPolicy.FileType = opts.FileType
+	}
+	if opts.DeleteAfterDays != 0 {
+		putPolicy.DeleteAfterDays = opts.DeleteAfterDays
+	}
+	if opts.FsizeMin != 0 {
+		putPolicy.FsizeMin = opts.FsizeMin
+	}
+	if opts.FsizeLimit != 0 {
+		putPolicy.FsizeLimit = opts.FsizeLimit
+	}
+	if opts.MimeLimit != "" {
+		putPolicy.MimeLimit = opts.MimeLimit
+	}
+	if opts.EndUser != "" {
+		putPolicy.EndUser = opts.EndUser
+	}
+	if opts.PersistentOps != "" {
+		putPolicy.PersistentOps = opts.PersistentOps
+	}
+	if opts.PersistentPipeline != "" {
+		putPolicy.PersistentPipeline = opts.PersistentPipeline
+	}
+	if opts.PersistentNotifyURL != "" {
+		putPolicy.PersistentNotifyURL = opts.PersistentNotifyURL
+	}
+	if opts.ReturnBody != "" {
+		putPolicy.ReturnBody = opts.ReturnBody
+	}
+	if opts.CallbackURL != "" {
+		putPolicy.CallbackURL = opts.CallbackURL
+	}
+	if opts.CallbackHost != "" {
+		putPolicy.CallbackHost = opts.CallbackHost
+	}
+	if opts.CallbackBody != "" {
+		putPolicy.CallbackBody = opts.CallbackBody
+	}
+	if opts.CallbackBodyType != "" {
+		putPolicy.CallbackBodyType = opts.CallbackBodyType
+	}
+	if opts.SaveKey != "" {
+		putPolicy.SaveKey = opts.SaveKey
+		putPolicy.ForceSaveKey = opts.ForceSaveKey
+	}
+}